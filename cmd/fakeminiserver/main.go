@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/zathras777/halox/internal/fakeminiserver"
+)
+
+func main() {
+	var listen, user, password, structureFile string
+	flag.StringVar(&listen, "listen", "127.0.0.1:8080", "Address to listen on")
+	flag.StringVar(&user, "user", "admin", "Username to accept")
+	flag.StringVar(&password, "password", "admin", "Password to accept")
+	flag.StringVar(&structureFile, "structure", "", "Structure file to serve instead of the built in one")
+	flag.Parse()
+
+	structure := fakeminiserver.DefaultStructure()
+	if len(structureFile) > 0 {
+		var err error
+		if structure, err = ioutil.ReadFile(structureFile); err != nil {
+			log.Fatalf("Unable to read structure file %s: %s", structureFile, err)
+		}
+	}
+	fake, err := fakeminiserver.NewWithStructure(listen, user, password, structure)
+	if err != nil {
+		log.Fatalf("Unable to start fake Miniserver: %s", err)
+	}
+	defer fake.Close()
+	log.Printf("Fake Miniserver listening on %s", fake.Address())
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	<-sigs
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/zathras777/halox/loxone"
+	"github.com/zathras777/halox/mqttbridge"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// After enabling updates the Miniserver sends every state, so wait until
+	// nothing has been received for a short time, or the limit is reached.
+	initialStatesQuiet = 500 * time.Millisecond
+	initialStatesLimit = 10 * time.Second
+)
+
+func connectMiniserver(ms miniserverConfig) (*loxone.Server, *loxone.Structure, error) {
+	ls := loxone.NewServer(ms.Host, ms.Port, ms.Username, ms.Password)
+	if err := ls.Connect(); err != nil {
+		return nil, nil, err
+	}
+	data, err := ls.StructureFile()
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to fetch the structure file: %s", err)
+	}
+	return ls, loxone.NewStructure(data, ls.Serial()), nil
+}
+
+/* Connect to the Miniserver selected with -miniserver. */
+func connectSelected(cfg yamlConfig) (*loxone.Server, *loxone.Structure, error) {
+	ms, err := cfg.selectedMiniserver()
+	if err != nil {
+		return nil, nil, err
+	}
+	return connectMiniserver(ms)
+}
+
+/* Find a control by UUID, action UUID or name, ignoring case. */
+func findControl(s *loxone.Structure, arg string) (*loxone.Entity, error) {
+	if le := s.FindControl(arg); le != nil {
+		return le, nil
+	}
+	var matches []*loxone.Entity
+	for _, le := range s.Controls {
+		if strings.EqualFold(le.Name, arg) {
+			matches = append(matches, le)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("No control named '%s'", arg)
+	case 1:
+		return matches[0], nil
+	}
+	return nil, fmt.Errorf("%d controls are named '%s', use the UUID", len(matches), arg)
+}
+
+func sortedControls(s *loxone.Structure) []*loxone.Entity {
+	rv := make([]*loxone.Entity, 0, len(s.Controls))
+	for _, le := range s.Controls {
+		rv = append(rv, le)
+	}
+	sort.Slice(rv, func(i, j int) bool {
+		if rv[i].Room != rv[j].Room {
+			return rv[i].Room < rv[j].Room
+		}
+		return rv[i].Name < rv[j].Name
+	})
+	return rv
+}
+
+/* A value as text, along with the formatted value if the state has a
+ * format. Daytimer and weather values are shown as JSON.
+ */
+func describeValue(le *loxone.Entity, state string, value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "-"
+	case float64:
+		text := strconv.FormatFloat(v, 'f', -1, 64)
+		if format := le.StateFormat(state); len(format) > 0 {
+			text += " (" + loxone.FormatValue(format, v) + ")"
+		}
+		return text
+	case string:
+		return strconv.Quote(v)
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(data)
+}
+
+func listControls(cfg yamlConfig, args []string) error {
+	_, s, err := connectSelected(cfg)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ROOM\tNAME\tTYPE\tUUID\tACTION UUID")
+	for _, le := range sortedControls(s) {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", le.Room, le.Name, le.Type,
+			loxone.UUIDString(le.UUID), loxone.UUIDString(le.ActionUUID))
+	}
+	return tw.Flush()
+}
+
+func showStates(cfg yamlConfig, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Usage: states <control>")
+	}
+	ls, s, err := connectSelected(cfg)
+	if err != nil {
+		return err
+	}
+	le, err := findControl(s, args[0])
+	if err != nil {
+		return err
+	}
+	if err := ls.EnableUpdates(); err != nil {
+		return err
+	}
+	limit := time.After(initialStatesLimit)
+	for done := false; !done; {
+		select {
+		case msg := <-ls.Updates():
+			s.Update(msg)
+		case <-time.After(initialStatesQuiet):
+			done = true
+		case <-limit:
+			done = true
+		}
+	}
+
+	fmt.Printf("%s (%s) in %s, action UUID %s\n", le.Name, le.Type, le.Room, loxone.UUIDString(le.ActionUUID))
+	names := make([]string, 0, len(le.States))
+	for name := range le.States {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "STATE\tUUID\tVALUE")
+	for _, name := range names {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", name, loxone.UUIDString(le.States[name]), describeValue(le, name, le.Values[name]))
+	}
+	return tw.Flush()
+}
+
+func sendCommand(cfg yamlConfig, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("Usage: send <control> <command>")
+	}
+	ls, s, err := connectSelected(cfg)
+	if err != nil {
+		return err
+	}
+	le, err := findControl(s, args[0])
+	if err != nil {
+		return err
+	}
+	cmd, err := le.Command([]byte(args[1]))
+	if err != nil {
+		return err
+	}
+	msg, err := ls.SendCommandResult(cmd)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: %v\n", msg.LL.Control, msg.LL.Value)
+	return nil
+}
+
+func watchUpdates(cfg yamlConfig, args []string) error {
+	ls, s, err := connectSelected(cfg)
+	if err != nil {
+		return err
+	}
+	var filter loxone.EventFilter
+	for _, arg := range args {
+		le, err := findControl(s, arg)
+		if err != nil {
+			return err
+		}
+		filter.Controls = append(filter.Controls, loxone.UUIDString(le.ActionUUID))
+	}
+	events := s.SubscribeBuffered(filter, 100, loxone.Block)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case msg := <-ls.Updates():
+				s.Update(msg)
+			case <-stop:
+				return
+			}
+		}
+	}()
+	if err := ls.EnableUpdates(); err != nil {
+		return err
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	for {
+		select {
+		case ev := <-events:
+			fmt.Printf("%s  %-30s %-20s %s\n", time.Now().Format("15:04:05.000"), ev.Entity.Name, ev.State,
+				describeValue(ev.Entity, ev.State, ev.Value))
+		case <-sigs:
+			s.Unsubscribe(events)
+			return nil
+		}
+	}
+}
+
+func dumpStructure(cfg yamlConfig, args []string) error {
+	ms, err := cfg.selectedMiniserver()
+	if err != nil {
+		return err
+	}
+	ls := loxone.NewServer(ms.Host, ms.Port, ms.Username, ms.Password)
+	if err := ls.Connect(); err != nil {
+		return err
+	}
+	data, err := ls.StructureFile()
+	if err != nil {
+		return err
+	}
+	out, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+func showDiscovery(cfg yamlConfig, args []string) error {
+	flags := flag.NewFlagSet("discovery", flag.ContinueOnError)
+	publish := flags.Bool("publish", false, "Publish the configs to the MQTT server")
+	asYaml := flags.Bool("yaml", false, "Print the equivalent Home Assistant YAML configuration")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	ms, err := cfg.selectedMiniserver()
+	if err != nil {
+		return err
+	}
+	ls, s, err := connectMiniserver(ms)
+	if err != nil {
+		return err
+	}
+	// Publishing is done explicitly below, not on connecting.
+	bc := cfg.bridgeConfig(ms)
+	bc.MQTT.Discovery = false
+	bridge, err := mqttbridge.New(ls, s, bc)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case *asYaml:
+		out, err := bridge.HassYaml()
+		if err != nil {
+			return err
+		}
+		fmt.Print(out)
+	case *publish:
+		if err := bridge.Connect(); err != nil {
+			return err
+		}
+		defer bridge.Close()
+		if err := bridge.PublishDiscovery(); err != nil {
+			return err
+		}
+		fmt.Printf("Published %d discovery configs\n", len(bridge.DiscoveryConfigs()))
+	default:
+		for _, dc := range bridge.DiscoveryConfigs() {
+			fmt.Printf("%s\n%s\n\n", dc.Topic, dc.Payload)
+		}
+	}
+	return nil
+}
+
+/* The configuration has already been checked when this runs, so print it
+ * with the defaults and environment overrides applied and the passwords
+ * hidden.
+ */
+func checkConfig(cfg yamlConfig, args []string) error {
+	if len(args) != 1 || args[0] != "check" {
+		return fmt.Errorf("Usage: config check")
+	}
+	hide := func(ms *miniserverConfig) {
+		if len(ms.Password) > 0 {
+			ms.Password = "[REDACTED]"
+		}
+	}
+	hide(&cfg.Loxone)
+	cfg.Miniservers = append([]miniserverConfig(nil), cfg.Miniservers...)
+	for n := range cfg.Miniservers {
+		hide(&cfg.Miniservers[n])
+	}
+	out, err := yaml.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("# Configuration is valid\n%s", out)
+	return nil
+}
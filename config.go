@@ -1,41 +1,254 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"sort"
+	"strings"
 
+	"github.com/zathras777/halox/logging"
+	"github.com/zathras777/halox/loxone"
+	"github.com/zathras777/halox/mqttbridge"
 	"gopkg.in/yaml.v2"
 )
 
+/* A Miniserver to bridge. Topic is the MQTT topic its states and actions
+ * are below, by default the mqtt topic for the loxone section and that
+ * followed by the name for each entry in the miniservers list.
+ */
+type miniserverConfig struct {
+	Name     string
+	Host     string
+	Port     int
+	Username string
+	Password string
+	Topic    string
+}
+
 type yamlConfig struct {
-	Loxone struct {
-		Host     string
-		Port     int
-		Username string
-		Password string
-	}
-	MQTT struct {
-		Host  string
-		Port  int
-		Topic string
-	}
-	Logging struct {
-		File   string
-		Syslog bool
+	Loxone            miniserverConfig
+	Miniservers       []miniserverConfig
+	mqttbridge.Config `yaml:",inline"`
+	Logging           logging.Config
+	HTTP              struct {
+		Listen string
 	}
+
+	// The Miniserver the other commands use, set by -miniserver.
+	selected string
 }
 
+/* Read the configuration file, apply any HALOX_* environment variable
+ * overrides and the defaults, then check it.
+ */
 func parseConfigFile(filename string) (cfg yamlConfig, err error) {
 	yamlFile, err := ioutil.ReadFile(filename)
 	if err != nil {
-		err = fmt.Errorf("Unable to read configuration file %s", filename)
+		err = fmt.Errorf("Unable to read configuration file %s: %s", filename, err)
 		return
 	}
 
-	err = yaml.Unmarshal(yamlFile, &cfg)
-	if err != nil {
-		fmt.Printf("Unable to parse the YAML file :-( %san", err)
+	if err = yaml.UnmarshalStrict(yamlFile, &cfg); err != nil {
+		err = fmt.Errorf("Unable to parse configuration file %s: %s", filename, err)
+		return
+	}
+	if err = cfg.applyEnv(); err != nil {
 		return
 	}
+	cfg.setDefaults()
+	if err = cfg.validate(); err != nil {
+		err = fmt.Errorf("Invalid configuration in %s:\n  %s", filename, err)
+	}
 	return
 }
+
+func (cfg *yamlConfig) setDefaults() {
+	if len(cfg.Miniservers) == 0 && cfg.Loxone.Port == 0 {
+		cfg.Loxone.Port = 80
+	}
+	for n := range cfg.Miniservers {
+		if cfg.Miniservers[n].Port == 0 {
+			cfg.Miniservers[n].Port = 80
+		}
+	}
+	if cfg.MQTT.Port == 0 {
+		cfg.MQTT.Port = 1883
+	}
+	if len(cfg.MQTT.Topic) == 0 {
+		cfg.MQTT.Topic = "loxone"
+	}
+	if len(cfg.MQTT.DiscoveryPrefix) == 0 {
+		cfg.MQTT.DiscoveryPrefix = "homeassistant"
+	}
+	if len(cfg.MQTT.Devices) == 0 {
+		cfg.MQTT.Devices = "room"
+	}
+}
+
+/* Check the configuration, returning every problem found, one per line. */
+func (cfg yamlConfig) validate() error {
+	var problems []string
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if len(cfg.Miniservers) > 0 && len(cfg.Loxone.Host) > 0 {
+		add("Use either the loxone section or the miniservers list, not both")
+	}
+	if _, err := cfg.miniservers(); err != nil {
+		add("%s", err)
+	}
+	sections := map[string]miniserverConfig{"loxone": cfg.Loxone}
+	if len(cfg.Miniservers) > 0 {
+		sections = make(map[string]miniserverConfig)
+		for n, ms := range cfg.Miniservers {
+			sections[fmt.Sprintf("miniservers[%d]", n)] = ms
+		}
+	}
+	for section, ms := range sections {
+		if len(ms.Host) == 0 {
+			add("%s: host is required", section)
+		}
+		if !validPort(ms.Port) {
+			add("%s: port %d is not between 1 and 65535", section, ms.Port)
+		}
+		if len(ms.Username) == 0 || len(ms.Password) == 0 {
+			add("%s: username and password are required", section)
+		}
+	}
+
+	if len(cfg.MQTT.Host) == 0 {
+		add("mqtt: host is required")
+	}
+	if !validPort(cfg.MQTT.Port) {
+		add("mqtt: port %d is not between 1 and 65535", cfg.MQTT.Port)
+	}
+	if cfg.MQTT.QoS < 0 || cfg.MQTT.QoS > 2 {
+		add("mqtt: qos %d is not 0, 1 or 2", cfg.MQTT.QoS)
+	}
+	if strings.ContainsAny(cfg.MQTT.Topic, "+#") {
+		add("mqtt: topic '%s' may not contain wildcards", cfg.MQTT.Topic)
+	}
+	if cfg.MQTT.Devices != "room" && cfg.MQTT.Devices != "control" {
+		add("mqtt: devices '%s' is not room or control", cfg.MQTT.Devices)
+	}
+	if cfg.MQTT.QueueSize < 0 || cfg.MQTT.JSONDebounce < 0 {
+		add("mqtt: queue_size and json_debounce may not be negative")
+	}
+
+	if _, err := logging.ParseLevel(cfg.Logging.Level); err != nil {
+		add("logging: %s", err)
+	}
+	for subsystem, level := range cfg.Logging.Levels {
+		if _, err := logging.ParseLevel(level); err != nil {
+			add("logging: levels: %s: %s", subsystem, err)
+		}
+	}
+	if f := cfg.Logging.Format; f != "" && f != "text" && f != "json" {
+		add("logging: format '%s' is not text or json", f)
+	}
+
+	if len(cfg.HTTP.Listen) > 0 {
+		if _, _, err := net.SplitHostPort(cfg.HTTP.Listen); err != nil {
+			add("http: listen '%s' is not a host:port address", cfg.HTTP.Listen)
+		}
+	}
+	selectors := map[string][]mqttbridge.ControlSelector{"include": cfg.Controls.Include,
+		"exclude": cfg.Controls.Exclude}
+	for name, list := range selectors {
+		for n, cs := range list {
+			if err := cs.Validate(); err != nil {
+				add("controls: %s[%d]: %s", name, n, err)
+			}
+		}
+	}
+	for n, pf := range cfg.Filters {
+		if err := pf.Validate(); err != nil {
+			add("filters[%d]: %s", n, err)
+		}
+	}
+	for uuidStr := range cfg.Overrides {
+		if _, err := loxone.ParseUUID(uuidStr); err != nil {
+			add("overrides: '%s' is not a UUID", uuidStr)
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Strings(problems)
+	return errors.New(strings.Join(problems, "\n  "))
+}
+
+func validPort(port int) bool {
+	return port > 0 && port < 65536
+}
+
+/* The Miniservers to bridge, either those in the miniservers list or the
+ * one in the loxone section.
+ */
+func (cfg yamlConfig) miniservers() ([]miniserverConfig, error) {
+	base := cfg.MQTT.Topic
+	if len(base) == 0 {
+		base = "loxone"
+	}
+	if len(cfg.Miniservers) == 0 {
+		ms := cfg.Loxone
+		if len(ms.Topic) == 0 {
+			ms.Topic = base
+		}
+		return []miniserverConfig{ms}, nil
+	}
+
+	var rv []miniserverConfig
+	names := make(map[string]bool)
+	topics := make(map[string]string)
+	for n, ms := range cfg.Miniservers {
+		if len(ms.Name) == 0 {
+			return nil, fmt.Errorf("Miniserver %d in the miniservers list has no name", n+1)
+		}
+		if names[ms.Name] {
+			return nil, fmt.Errorf("More than one Miniserver is named '%s'", ms.Name)
+		}
+		names[ms.Name] = true
+		if len(ms.Topic) == 0 {
+			ms.Topic = base + "/" + ms.Name
+		}
+		if other, ck := topics[ms.Topic]; ck {
+			return nil, fmt.Errorf("Miniservers '%s' and '%s' both use the topic %s", other, ms.Name, ms.Topic)
+		}
+		topics[ms.Topic] = ms.Name
+		rv = append(rv, ms)
+	}
+	return rv, nil
+}
+
+/* The Miniserver selected with -miniserver, or the first. */
+func (cfg yamlConfig) selectedMiniserver() (miniserverConfig, error) {
+	servers, err := cfg.miniservers()
+	if err != nil {
+		return miniserverConfig{}, err
+	}
+	if len(cfg.selected) == 0 {
+		return servers[0], nil
+	}
+	for _, ms := range servers {
+		if ms.Name == cfg.selected {
+			return ms, nil
+		}
+	}
+	return miniserverConfig{}, fmt.Errorf("No Miniserver named '%s' in the configuration", cfg.selected)
+}
+
+/* The bridge configuration for one of the Miniservers. With a miniservers
+ * list unique IDs include the serial number, even if there is only one, so
+ * that adding another does not change them.
+ */
+func (cfg yamlConfig) bridgeConfig(ms miniserverConfig) mqttbridge.Config {
+	bc := cfg.Config
+	bc.MQTT.Topic = ms.Topic
+	bc.QualifyIDs = len(cfg.Miniservers) > 0
+	return bc
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const minimalConfig = `
+loxone:
+  host: 192.168.1.10
+  username: admin
+  password: secret
+mqtt:
+  host: 127.0.0.1
+`
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "configuration.yaml")
+	if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestConfigDefaults(t *testing.T) {
+	cfg, err := parseConfigFile(writeConfig(t, minimalConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Loxone.Port != 80 || cfg.MQTT.Port != 1883 || cfg.MQTT.Topic != "loxone" ||
+		cfg.MQTT.DiscoveryPrefix != "homeassistant" || cfg.MQTT.Devices != "room" {
+		t.Errorf("Defaults not applied: %+v %+v", cfg.Loxone, cfg.MQTT)
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	_, err := parseConfigFile(writeConfig(t, `
+loxone:
+  port: 70000
+mqtt:
+  host: 127.0.0.1
+  qos: 3
+logging:
+  level: loud
+`))
+	if err == nil {
+		t.Fatal("No error for an invalid configuration")
+	}
+	for _, expected := range []string{"loxone: host is required", "loxone: port 70000", "loxone: username and password",
+		"mqtt: qos 3", "logging: Unknown log level"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("'%s' not reported in\n%s", expected, err)
+		}
+	}
+
+	_, err = parseConfigFile(writeConfig(t, minimalConfig+`
+controls:
+  include:
+    - name: "Kitchen [Light"
+  exclude:
+    - uuid: 0f2f3d4e-0123-4567-ffffeeee0011223
+filters:
+  - type: Meter
+    deadband: -1
+overrides:
+  not-a-uuid:
+    name: Light
+`))
+	if err == nil {
+		t.Fatal("No error for invalid selectors and filters")
+	}
+	for _, expected := range []string{"controls: include[0]: Invalid name pattern", "controls: exclude[0]: '0f2f3d4e",
+		"filters[0]: deadband", "overrides: 'not-a-uuid'"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("'%s' not reported in\n%s", expected, err)
+		}
+	}
+
+	if _, err := parseConfigFile(writeConfig(t, minimalConfig+"  hots: example\n")); err == nil {
+		t.Error("No error for an unknown field")
+	}
+}
+
+func TestConfigEnvironment(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(secret, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("HALOX_MQTT_PORT", "1884")
+	t.Setenv("HALOX_MQTT_DISCOVERY", "true")
+	t.Setenv("HALOX_MINISERVER_WORK_SHOP_PASSWORD_FILE", secret)
+
+	cfg, err := parseConfigFile(writeConfig(t, `
+miniservers:
+  - name: house
+    host: 192.168.1.10
+    username: admin
+    password: secret
+  - name: work-shop
+    host: 192.168.2.10
+    username: admin
+mqtt:
+  host: 127.0.0.1
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MQTT.Port != 1884 || !cfg.MQTT.Discovery {
+		t.Errorf("MQTT settings not overridden: %+v", cfg.MQTT)
+	}
+	if cfg.Miniservers[1].Password != "from-file" || cfg.Miniservers[0].Password != "secret" {
+		t.Errorf("Passwords %s and %s, expected secret and from-file", cfg.Miniservers[0].Password, cfg.Miniservers[1].Password)
+	}
+
+	t.Setenv("HALOX_MQTT_PORT", "many")
+	if _, err := parseConfigFile(writeConfig(t, minimalConfig)); err == nil || !strings.Contains(err.Error(), "HALOX_MQTT_PORT") {
+		t.Errorf("Invalid environment value not reported: %v", err)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const envPrefix = "HALOX_"
+
+/* The settings that can be set by environment variables, keyed by the
+ * variable name without the HALOX_ prefix. Miniservers in the miniservers
+ * list use HALOX_MINISERVER_<NAME>_..., with the name in upper case.
+ */
+func (cfg *yamlConfig) envSettings() map[string]interface{} {
+	settings := map[string]interface{}{
+		"LOXONE_HOST":           &cfg.Loxone.Host,
+		"LOXONE_PORT":           &cfg.Loxone.Port,
+		"LOXONE_USERNAME":       &cfg.Loxone.Username,
+		"LOXONE_PASSWORD":       &cfg.Loxone.Password,
+		"MQTT_HOST":             &cfg.MQTT.Host,
+		"MQTT_PORT":             &cfg.MQTT.Port,
+		"MQTT_TOPIC":            &cfg.MQTT.Topic,
+		"MQTT_QOS":              &cfg.MQTT.QoS,
+		"MQTT_DISCOVERY":        &cfg.MQTT.Discovery,
+		"MQTT_DISCOVERY_PREFIX": &cfg.MQTT.DiscoveryPrefix,
+		"MQTT_DEVICES":          &cfg.MQTT.Devices,
+		"MQTT_JSON_STATE":       &cfg.MQTT.JSONState,
+		"MQTT_JSON_DEBOUNCE":    &cfg.MQTT.JSONDebounce,
+		"LOGGING_LEVEL":         &cfg.Logging.Level,
+		"LOGGING_FORMAT":        &cfg.Logging.Format,
+		"LOGGING_FILE":          &cfg.Logging.File,
+		"HTTP_LISTEN":           &cfg.HTTP.Listen,
+	}
+	for n := range cfg.Miniservers {
+		ms := &cfg.Miniservers[n]
+		prefix := "MINISERVER_" + envName(ms.Name) + "_"
+		settings[prefix+"HOST"] = &ms.Host
+		settings[prefix+"PORT"] = &ms.Port
+		settings[prefix+"USERNAME"] = &ms.Username
+		settings[prefix+"PASSWORD"] = &ms.Password
+		settings[prefix+"TOPIC"] = &ms.Topic
+	}
+	return settings
+}
+
+/* Override settings from HALOX_* environment variables. If HALOX_<NAME> is
+ * not set, HALOX_<NAME>_FILE names a file to read the value from, e.g. a
+ * Docker secret containing a password.
+ */
+func (cfg *yamlConfig) applyEnv() error {
+	for name, target := range cfg.envSettings() {
+		value, ck, err := lookupEnv(envPrefix + name)
+		if err != nil {
+			return err
+		}
+		if !ck {
+			continue
+		}
+		if err := setValue(target, value); err != nil {
+			return fmt.Errorf("Invalid value for %s%s: %s", envPrefix, name, err)
+		}
+	}
+	return nil
+}
+
+func lookupEnv(name string) (string, bool, error) {
+	if value, ck := os.LookupEnv(name); ck {
+		return value, true, nil
+	}
+	filename, ck := os.LookupEnv(name + "_FILE")
+	if !ck {
+		return "", false, nil
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return "", false, fmt.Errorf("Unable to read %s_FILE: %s", name, err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), true, nil
+}
+
+func setValue(target interface{}, value string) (err error) {
+	switch t := target.(type) {
+	case *string:
+		*t = value
+	case *int:
+		*t, err = strconv.Atoi(value)
+	case *bool:
+		*t, err = strconv.ParseBool(value)
+	case *time.Duration:
+		*t, err = time.ParseDuration(value)
+	default:
+		err = fmt.Errorf("Unsupported setting type %T", target)
+	}
+	return
+}
+
+/* A name as used in an environment variable, upper case with anything other
+ * than letters and digits replaced by underscores.
+ */
+func envName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, name)
+}
@@ -0,0 +1,175 @@
+// Package health reports whether the connection to the Miniserver and the
+// MQTT bridge are working, on /healthz and /readyz style HTTP endpoints for
+// Docker, Kubernetes or systemd.
+package health
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/zathras777/halox/loxone"
+	"github.com/zathras777/halox/mqttbridge"
+)
+
+const (
+	DefaultMaxMessageAge = 30 * time.Second
+	DefaultGrace         = time.Minute
+)
+
+/* The result of a check, returned as JSON by both endpoints. MQTTConnected
+ * is omitted when there is no bridge.
+ */
+type Status struct {
+	Ready              bool      `json:"ready"`
+	Healthy            bool      `json:"healthy"`
+	WebsocketConnected bool      `json:"websocket_connected"`
+	LastMessage        time.Time `json:"last_message"`
+	TokenValidUntil    time.Time `json:"token_valid_until"`
+	MQTTConnected      *bool     `json:"mqtt_connected,omitempty"`
+	Problems           []string  `json:"problems,omitempty"`
+}
+
+/* Checks a Miniserver connection and, optionally, the bridge publishing it
+ * to MQTT. It is ready while there are no problems and healthy unless there
+ * have been problems for longer than Grace, so that an orchestrator does
+ * not restart halox while it is reconnecting.
+ */
+type Checker struct {
+	// Longest time without a message from the Miniserver before it is a
+	// problem. Keepalives are answered every 5 seconds once status updates
+	// are enabled. Zero disables the check.
+	MaxMessageAge time.Duration
+	Grace         time.Duration
+
+	server *loxone.Server
+	bridge *mqttbridge.Bridge
+
+	lock          sync.Mutex
+	degradedSince time.Time
+}
+
+/* Create a checker with the default limits. The bridge may be nil. */
+func New(server *loxone.Server, bridge *mqttbridge.Bridge) *Checker {
+	return &Checker{MaxMessageAge: DefaultMaxMessageAge, Grace: DefaultGrace,
+		server: server, bridge: bridge}
+}
+
+/* Check the connections now. */
+func (c *Checker) Check() Status {
+	now := time.Now()
+	stats := c.server.Stats()
+	st := Status{
+		WebsocketConnected: stats.Connected,
+		LastMessage:        stats.LastMessage,
+		TokenValidUntil:    stats.TokenExpiration,
+	}
+	if !stats.Connected {
+		st.Problems = append(st.Problems, "Websocket to the Miniserver is not connected")
+	}
+	if stats.LastMessage.IsZero() {
+		st.Problems = append(st.Problems, "No message received from the Miniserver")
+	} else if age := now.Sub(stats.LastMessage); c.MaxMessageAge > 0 && age > c.MaxMessageAge {
+		st.Problems = append(st.Problems, fmt.Sprintf("No message received from the Miniserver for %s", age.Round(time.Second)))
+	}
+	if !stats.TokenExpiration.After(now) {
+		st.Problems = append(st.Problems, "Token is not valid")
+	}
+	if c.bridge != nil {
+		connected := c.bridge.MQTTConnected()
+		st.MQTTConnected = &connected
+		if !connected {
+			st.Problems = append(st.Problems, "MQTT is not connected")
+		}
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	st.Ready = len(st.Problems) == 0
+	if st.Ready {
+		c.degradedSince = time.Time{}
+	} else if c.degradedSince.IsZero() {
+		c.degradedSince = now
+	}
+	st.Healthy = st.Ready || now.Sub(c.degradedSince) < c.Grace
+	return st
+}
+
+/* Liveness: 503 once there have been problems for longer than Grace. */
+func (c *Checker) Healthz() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		st := c.Check()
+		writeStatus(w, st, st.Healthy)
+	})
+}
+
+/* Readiness: 503 while there are any problems. */
+func (c *Checker) Readyz() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		st := c.Check()
+		writeStatus(w, st, st.Ready)
+	})
+}
+
+/* The result of checking several Miniservers, keyed by name. */
+type GroupStatus struct {
+	Ready       bool              `json:"ready"`
+	Healthy     bool              `json:"healthy"`
+	Miniservers map[string]Status `json:"miniservers"`
+}
+
+/* Checks several Miniservers, each with its own Checker. The group is only
+ * ready, or healthy, while every Miniserver is.
+ */
+type Group struct {
+	checkers map[string]*Checker
+}
+
+func NewGroup() *Group {
+	return &Group{checkers: make(map[string]*Checker)}
+}
+
+/* Add the checker for a Miniserver. Call before the endpoints are used. */
+func (g *Group) Add(name string, c *Checker) {
+	g.checkers[name] = c
+}
+
+/* Check every Miniserver now. */
+func (g *Group) Check() GroupStatus {
+	gs := GroupStatus{Ready: true, Healthy: true, Miniservers: make(map[string]Status)}
+	for name, c := range g.checkers {
+		st := c.Check()
+		gs.Ready = gs.Ready && st.Ready
+		gs.Healthy = gs.Healthy && st.Healthy
+		gs.Miniservers[name] = st
+	}
+	return gs
+}
+
+/* Liveness: 503 once any Miniserver is not healthy. */
+func (g *Group) Healthz() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gs := g.Check()
+		writeStatus(w, gs, gs.Healthy)
+	})
+}
+
+/* Readiness: 503 while any Miniserver has problems. */
+func (g *Group) Readyz() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gs := g.Check()
+		writeStatus(w, gs, gs.Ready)
+	})
+}
+
+func writeStatus(w http.ResponseWriter, st interface{}, ok bool) {
+	w.Header().Set("Content-Type", "application/json")
+	if ok {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(st)
+}
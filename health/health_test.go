@@ -0,0 +1,105 @@
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/zathras777/halox/internal/fakeminiserver"
+	"github.com/zathras777/halox/loxone"
+)
+
+func get(t *testing.T, h http.Handler) (int, Status) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	var st Status
+	if err := json.NewDecoder(rec.Body).Decode(&st); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Code, st
+}
+
+func TestHealthy(t *testing.T) {
+	ls, _ := fakeminiserver.ConnectClient(t, fakeminiserver.Start(t), loxone.NewServer)
+	c := New(ls, nil)
+
+	code, st := get(t, c.Readyz())
+	if code != http.StatusOK || !st.Ready || !st.WebsocketConnected || len(st.Problems) > 0 {
+		t.Errorf("Readyz returned %d, %+v", code, st)
+	}
+	if st.MQTTConnected != nil {
+		t.Error("MQTT state reported without a bridge")
+	}
+	if code, _ := get(t, c.Healthz()); code != http.StatusOK {
+		t.Errorf("Healthz returned %d, expected 200", code)
+	}
+}
+
+func TestDegraded(t *testing.T) {
+	ls, _ := fakeminiserver.ConnectClient(t, fakeminiserver.Start(t), loxone.NewServer)
+	c := New(ls, nil)
+	c.MaxMessageAge = time.Nanosecond
+
+	code, st := get(t, c.Readyz())
+	if code != http.StatusServiceUnavailable || st.Ready || len(st.Problems) != 1 {
+		t.Errorf("Readyz returned %d, %+v, expected 503 with one problem", code, st)
+	}
+	// Still within the grace period.
+	if code, st := get(t, c.Healthz()); code != http.StatusOK || !st.Healthy {
+		t.Errorf("Healthz returned %d, %+v, expected 200", code, st)
+	}
+	c.Grace = 0
+	if code, st := get(t, c.Healthz()); code != http.StatusServiceUnavailable || st.Healthy {
+		t.Errorf("Healthz returned %d, %+v, expected 503", code, st)
+	}
+
+	c.MaxMessageAge = DefaultMaxMessageAge
+	if code, _ := get(t, c.Healthz()); code != http.StatusOK {
+		t.Errorf("Healthz returned %d after recovering, expected 200", code)
+	}
+}
+
+func TestWebsocketLost(t *testing.T) {
+	fake := fakeminiserver.Start(t)
+	ls, _ := fakeminiserver.ConnectClient(t, fake, loxone.NewServer)
+	c := New(ls, nil)
+	fake.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		code, st := get(t, c.Readyz())
+		if code == http.StatusServiceUnavailable && !st.WebsocketConnected {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Readyz returned %d, %+v after the Miniserver closed", code, st)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestGroup(t *testing.T) {
+	house, _ := fakeminiserver.ConnectClient(t, fakeminiserver.Start(t), loxone.NewServer)
+	garage, _ := fakeminiserver.ConnectClient(t, fakeminiserver.Start(t), loxone.NewServer)
+	g := NewGroup()
+	g.Add("house", New(house, nil))
+	degraded := New(garage, nil)
+	degraded.MaxMessageAge = time.Nanosecond
+	g.Add("garage", degraded)
+
+	rec := httptest.NewRecorder()
+	g.Readyz().ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	var gs GroupStatus
+	if err := json.NewDecoder(rec.Body).Decode(&gs); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusServiceUnavailable || gs.Ready || !gs.Healthy {
+		t.Errorf("Readyz returned %d, %+v, expected 503 and healthy", rec.Code, gs)
+	}
+	if !gs.Miniservers["house"].Ready || gs.Miniservers["garage"].Ready {
+		t.Errorf("Unexpected Miniserver states %+v", gs.Miniservers)
+	}
+}
@@ -0,0 +1,40 @@
+package fakeminiserver
+
+import "testing"
+
+// Client is the part of a Miniserver client, such as loxone.Server, used
+// by ConnectClient. The loxone package isn't imported so that its own
+// tests can use this package.
+type Client interface {
+	Connect() error
+	StructureFile() (map[string]interface{}, error)
+}
+
+// Start starts a fake Miniserver serving the default structure file,
+// closing it when the test ends.
+func Start(t testing.TB) *Server {
+	t.Helper()
+	fake, err := New("127.0.0.1:0", "admin", "secret")
+	if err != nil {
+		t.Fatalf("Unable to start fake Miniserver: %s", err)
+	}
+	t.Cleanup(fake.Close)
+	return fake
+}
+
+// ConnectClient creates a client for the fake Miniserver with newClient,
+// e.g. loxone.NewServer, connects it and fetches the structure file,
+// failing the test if either doesn't work.
+func ConnectClient[C Client](t testing.TB, fake *Server,
+	newClient func(host string, port int, username, password string) C) (C, map[string]interface{}) {
+	t.Helper()
+	client := newClient(fake.Host, fake.Port, fake.Username, fake.Password)
+	if err := client.Connect(); err != nil {
+		t.Fatalf("Connect() failed: %s", err)
+	}
+	data, err := client.StructureFile()
+	if err != nil {
+		t.Fatalf("StructureFile() failed: %s", err)
+	}
+	return client, data
+}
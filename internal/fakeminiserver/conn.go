@@ -0,0 +1,272 @@
+package fakeminiserver
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+var loxoneTimeBase = time.Date(2009, 01, 01, 0, 0, 0, 0, time.UTC)
+
+// A single websocket connection and the session key it has exchanged.
+type wsConn struct {
+	ws     *websocket.Conn
+	server *Server
+	lock   sync.Mutex
+
+	aesKey  []byte
+	aesIV   []byte
+	updates bool
+}
+
+/* Every message is sent as an 8 byte header, giving the type and length,
+ * followed by the payload. Keepalive responses are only a header.
+ */
+func (c *wsConn) send(msgType byte, payload []byte) error {
+	header := []byte{0x03, msgType, 0, 0, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(header[4:], uint32(len(payload)))
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, header); err != nil {
+		return err
+	}
+	if msgType == 6 {
+		return nil
+	}
+	frameType := websocket.BinaryMessage
+	if msgType == 0 || msgType == 1 {
+		frameType = websocket.TextMessage
+	}
+	return c.ws.WriteMessage(frameType, payload)
+}
+
+func (c *wsConn) respond(control string, value interface{}, code int) error {
+	payload, err := json.Marshal(llMessage(control, value, code))
+	if err != nil {
+		return err
+	}
+	return c.send(0, payload)
+}
+
+func (c *wsConn) handle(cmd string) error {
+	switch {
+	case cmd == "keepalive":
+		return c.send(6, nil)
+	case cmd == "data/LoxApp3.json":
+		return c.send(1, c.server.structure)
+	case strings.HasPrefix(cmd, "jdev/sys/keyexchange/"):
+		return c.keyExchange(cmd)
+	case strings.HasPrefix(cmd, "jdev/sys/getkey2/"):
+		return c.respond(cmd, map[string]string{
+			"key":     hex.EncodeToString(c.server.hashKey),
+			"salt":    c.server.hashSalt,
+			"hashAlg": "SHA256",
+		}, 200)
+	case strings.HasPrefix(cmd, "jdev/sys/enc/"):
+		inner, err := c.decryptCommand(strings.TrimPrefix(cmd, "jdev/sys/enc/"))
+		if err != nil {
+			return c.respond(cmd, err.Error(), 400)
+		}
+		return c.handleEncrypted(inner)
+	case cmd == "jdev/sps/enablebinstatusupdate":
+		return c.enableUpdates(cmd)
+	case strings.HasPrefix(cmd, "jdev/sps/io/"):
+		return c.respond(cmd, c.server.recordCommand(cmd), 200)
+	}
+	return c.respond(cmd, "Unknown command", 404)
+}
+
+func (c *wsConn) handleEncrypted(cmd string) error {
+	parts := strings.Split(cmd, "/")
+	switch {
+	case strings.HasPrefix(cmd, "jdev/sys/getjwt/") && len(parts) >= 5:
+		if !strings.EqualFold(parts[3], c.server.userHash()) || parts[4] != c.server.Username {
+			return c.respond(cmd, "Invalid user or password", 401)
+		}
+		return c.respond(cmd, c.server.tokenResponse(c.server.newToken()), 200)
+	case (strings.HasPrefix(cmd, "jdev/sys/refreshjwt/") || strings.HasPrefix(cmd, "jdev/sys/checktoken/")) && len(parts) >= 5:
+		for _, token := range c.server.tokenValues() {
+			if strings.EqualFold(parts[3], c.server.hmacHex(token)) {
+				return c.respond(cmd, c.server.tokenResponse(token), 200)
+			}
+		}
+		return c.respond(cmd, "Invalid token", 401)
+	}
+	return c.handle(cmd)
+}
+
+func (c *wsConn) keyExchange(cmd string) error {
+	encrypted, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(cmd, "jdev/sys/keyexchange/"))
+	if err != nil {
+		return c.respond(cmd, "Invalid session key", 400)
+	}
+	plain, err := rsa.DecryptPKCS1v15(rand.Reader, c.server.privateKey, encrypted)
+	if err != nil {
+		return c.respond(cmd, "Invalid session key", 400)
+	}
+	parts := strings.Split(string(plain), ":")
+	if len(parts) != 2 {
+		return c.respond(cmd, "Invalid session key", 400)
+	}
+	if c.aesKey, err = hex.DecodeString(parts[0]); err != nil {
+		return c.respond(cmd, "Invalid session key", 400)
+	}
+	if c.aesIV, err = hex.DecodeString(parts[1]); err != nil {
+		return c.respond(cmd, "Invalid session key", 400)
+	}
+	block, err := aes.NewCipher(c.aesKey)
+	if err != nil {
+		return c.respond(cmd, "Invalid session key", 400)
+	}
+	salt := make([]byte, aes.BlockSize)
+	rand.Read(salt)
+	encSalt := make([]byte, aes.BlockSize)
+	block.Encrypt(encSalt, salt)
+	return c.respond(cmd, base64.StdEncoding.EncodeToString(encSalt), 200)
+}
+
+/* Encrypted commands are "salt/<salt>/<command>\0", AES-CBC encrypted with
+ * the session key, base64 encoded and URL escaped.
+ */
+func (c *wsConn) decryptCommand(escaped string) (string, error) {
+	if len(c.aesKey) == 0 {
+		return "", fmt.Errorf("No session key exchanged")
+	}
+	b64, err := url.QueryUnescape(escaped)
+	if err != nil {
+		return "", err
+	}
+	enc, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return "", err
+	}
+	if len(enc) == 0 || len(enc)%aes.BlockSize != 0 {
+		return "", fmt.Errorf("Invalid encrypted command length %d", len(enc))
+	}
+	block, err := aes.NewCipher(c.aesKey)
+	if err != nil {
+		return "", err
+	}
+	plain := make([]byte, len(enc))
+	cipher.NewCBCDecrypter(block, c.aesIV).CryptBlocks(plain, enc)
+	if n := bytes.IndexByte(plain, 0); n >= 0 {
+		plain = plain[:n]
+	}
+	parts := strings.SplitN(string(plain), "/", 3)
+	if len(parts) != 3 || parts[0] != "salt" {
+		return "", fmt.Errorf("Invalid encrypted command")
+	}
+	return parts[2], nil
+}
+
+/* The response to enabling updates is followed by the current value of
+ * every state, as the Miniserver does.
+ */
+func (c *wsConn) enableUpdates(cmd string) error {
+	if err := c.respond(cmd, "1", 200); err != nil {
+		return err
+	}
+	c.server.lock.Lock()
+	c.updates = true
+	c.server.lock.Unlock()
+
+	values, texts := c.server.stateSnapshot()
+	if len(values) > 0 {
+		if err := c.send(2, encodeValueStates(values)); err != nil {
+			return err
+		}
+	}
+	if len(texts) > 0 {
+		return c.send(3, encodeTextStates(texts))
+	}
+	return nil
+}
+
+func (s *Server) hmacHex(data string) string {
+	mac := hmac.New(sha256.New, s.hashKey)
+	mac.Write([]byte(data))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *Server) userHash() string {
+	pwHash := sha256.Sum256([]byte(s.Password + ":" + s.hashSalt))
+	return s.hmacHex(s.Username + ":" + strings.ToUpper(hex.EncodeToString(pwHash[:])))
+}
+
+func (s *Server) tokenResponse(token string) map[string]interface{} {
+	validUntil := time.Now().Add(s.TokenLifetime).Sub(loxoneTimeBase) / time.Second
+	return map[string]interface{}{
+		"token":        token,
+		"validUntil":   int64(validUntil),
+		"tokenRights":  2,
+		"unsecurePass": false,
+	}
+}
+
+/* UUIDs are sent with the first three fields little endian. */
+func encodeUUID(uu uuid.UUID) []byte {
+	return []byte{uu[3], uu[2], uu[1], uu[0], uu[5], uu[4], uu[7], uu[6],
+		uu[8], uu[9], uu[10], uu[11], uu[12], uu[13], uu[14], uu[15]}
+}
+
+// Each value state is the UUID followed by the value as a float64.
+func encodeValueStates(values map[uuid.UUID]float64) []byte {
+	var buf bytes.Buffer
+	for uu, value := range values {
+		buf.Write(encodeUUID(uu))
+		binary.Write(&buf, binary.LittleEndian, math.Float64bits(value))
+	}
+	return buf.Bytes()
+}
+
+// Each text state is the UUID, the icon UUID, the text length as a uint32
+// and the text padded to a multiple of 4 bytes.
+func encodeTextStates(texts map[uuid.UUID]string) []byte {
+	var buf bytes.Buffer
+	for uu, text := range texts {
+		buf.Write(encodeUUID(uu))
+		buf.Write(make([]byte, 16))
+		binary.Write(&buf, binary.LittleEndian, uint32(len(text)))
+		buf.WriteString(text)
+		if pad := len(text) % 4; pad != 0 {
+			buf.Write(make([]byte, 4-pad))
+		}
+	}
+	return buf.Bytes()
+}
+
+// Each daytimer state is the UUID, the default value as a float64 and the
+// number of entries as a uint32, followed by the entries.
+func encodeDaytimerState(uu uuid.UUID, defValue float64, entries []DaytimerEntry) []byte {
+	var buf bytes.Buffer
+	buf.Write(encodeUUID(uu))
+	binary.Write(&buf, binary.LittleEndian, math.Float64bits(defValue))
+	binary.Write(&buf, binary.LittleEndian, uint32(len(entries)))
+	for _, entry := range entries {
+		var needActivate int32
+		if entry.NeedActivate {
+			needActivate = 1
+		}
+		binary.Write(&buf, binary.LittleEndian, []int32{int32(entry.Mode), int32(entry.From), int32(entry.To), needActivate})
+		binary.Write(&buf, binary.LittleEndian, math.Float64bits(entry.Value))
+	}
+	return buf.Bytes()
+}
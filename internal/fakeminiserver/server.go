@@ -0,0 +1,387 @@
+// Package fakeminiserver provides an in-process Loxone Miniserver for tests
+// and local development. It implements enough of the HTTP and websocket API
+// for halox to connect, exchange keys, authenticate, fetch the structure
+// file, receive status updates and send commands.
+package fakeminiserver
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	_ "embed"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+//go:embed structure.json
+var defaultStructure []byte
+
+// DefaultStructure returns the structure file served unless another is
+// given to NewWithStructure.
+func DefaultStructure() []byte {
+	return append([]byte(nil), defaultStructure...)
+}
+
+// Server is a fake Miniserver listening on Host:Port.
+type Server struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	Serial   string
+	Version  string
+
+	// How long tokens issued by the server are valid for.
+	TokenLifetime time.Duration
+
+	listener   net.Listener
+	httpServer *http.Server
+	privateKey *rsa.PrivateKey
+	structure  []byte
+	hashKey    []byte
+	hashSalt   string
+
+	lock      sync.Mutex
+	values    map[uuid.UUID]float64
+	texts     map[uuid.UUID]string
+	tokens    map[string]bool
+	responses map[string]interface{}
+	delays    map[string]time.Duration
+	commands  []string
+	conns     map[*wsConn]bool
+	commandCh chan string
+}
+
+// New starts a fake Miniserver on addr, e.g. "127.0.0.1:0", serving the
+// default structure file and accepting the given user.
+func New(addr, username, password string) (*Server, error) {
+	return NewWithStructure(addr, username, password, defaultStructure)
+}
+
+// NewWithStructure starts a fake Miniserver serving the given structure
+// file. Every state listed in the structure file starts with the value 0.
+func NewWithStructure(addr, username, password string, structure []byte) (*Server, error) {
+	var parsed struct {
+		GlobalStates map[string]string
+		Controls     map[string]struct {
+			States map[string]interface{}
+		}
+	}
+	if err := json.Unmarshal(structure, &parsed); err != nil {
+		return nil, fmt.Errorf("Unable to parse structure file: %s", err)
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	hashKey := make([]byte, 20)
+	rand.Read(hashKey)
+	hashSalt := make([]byte, 16)
+	rand.Read(hashSalt)
+
+	s := &Server{
+		Username:      username,
+		Password:      password,
+		Serial:        "504F94000001",
+		Version:       "12.0.2.24",
+		TokenLifetime: time.Hour,
+		privateKey:    key,
+		structure:     structure,
+		hashKey:       hashKey,
+		hashSalt:      fmt.Sprintf("%x", hashSalt),
+		values:        make(map[uuid.UUID]float64),
+		texts:         make(map[uuid.UUID]string),
+		tokens:        make(map[string]bool),
+		responses:     make(map[string]interface{}),
+		delays:        make(map[string]time.Duration),
+		conns:         make(map[*wsConn]bool),
+		commandCh:     make(chan string, 100),
+	}
+	for _, uuidStr := range parsed.GlobalStates {
+		s.initValue(uuidStr)
+	}
+	for _, ctl := range parsed.Controls {
+		for _, uuidStr := range ctl.States {
+			if str, ck := uuidStr.(string); ck {
+				s.initValue(str)
+			}
+		}
+	}
+
+	s.listener, err = net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	tcpAddr := s.listener.Addr().(*net.TCPAddr)
+	s.Host = tcpAddr.IP.String()
+	s.Port = tcpAddr.Port
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/jdev/cfg/apiKey", s.handleAPIKey)
+	mux.HandleFunc("/jdev/sys/getPublicKey", s.handlePublicKey)
+	mux.HandleFunc("/ws/rfc6455", s.handleWebsocket)
+	s.httpServer = &http.Server{Handler: mux}
+	go s.httpServer.Serve(s.listener)
+	return s, nil
+}
+
+func (s *Server) initValue(uuidStr string) {
+	if uu, err := parseUUID(uuidStr); err == nil {
+		s.values[uu] = 0
+	}
+}
+
+// Address returns host:port as used by halox.
+func (s *Server) Address() string {
+	return fmt.Sprintf("%s:%d", s.Host, s.Port)
+}
+
+// Close stops the server and closes all websocket connections.
+func (s *Server) Close() {
+	s.httpServer.Close()
+	s.DropConnections()
+}
+
+// DropConnections closes all websocket connections, e.g. to test
+// reconnection.
+func (s *Server) DropConnections() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for c := range s.conns {
+		c.ws.Close()
+		delete(s.conns, c)
+	}
+}
+
+// SetValue sets a value state and sends it to every client that has
+// enabled status updates.
+func (s *Server) SetValue(uuidStr string, value float64) error {
+	uu, err := parseUUID(uuidStr)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	s.values[uu] = value
+	s.lock.Unlock()
+	s.SendStatus(2, encodeValueStates(map[uuid.UUID]float64{uu: value}))
+	return nil
+}
+
+// SetText sets a text state and sends it to every client that has enabled
+// status updates.
+func (s *Server) SetText(uuidStr, text string) error {
+	uu, err := parseUUID(uuidStr)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	delete(s.values, uu)
+	s.texts[uu] = text
+	s.lock.Unlock()
+	s.SendStatus(3, encodeTextStates(map[uuid.UUID]string{uu: text}))
+	return nil
+}
+
+// DaytimerEntry is one entry of a daytimer schedule. From and To are
+// minutes since midnight.
+type DaytimerEntry struct {
+	Mode         int
+	From         int
+	To           int
+	NeedActivate bool
+	Value        float64
+}
+
+// SetDaytimer sends a daytimer state to every client that has enabled
+// status updates.
+func (s *Server) SetDaytimer(uuidStr string, defValue float64, entries []DaytimerEntry) error {
+	uu, err := parseUUID(uuidStr)
+	if err != nil {
+		return err
+	}
+	s.SendStatus(4, encodeDaytimerState(uu, defValue, entries))
+	return nil
+}
+
+// SendStatus sends a raw status message of the given type (2 value states,
+// 3 text states, 4 daytimer states, 7 weather states) to every client that
+// has enabled status updates.
+func (s *Server) SendStatus(msgType byte, data []byte) {
+	for _, c := range s.updateConns() {
+		if err := c.send(msgType, data); err != nil {
+			log.Printf("fakeminiserver: unable to send status: %s", err)
+		}
+	}
+}
+
+func (s *Server) updateConns() []*wsConn {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var rv []*wsConn
+	for c := range s.conns {
+		if c.updates {
+			rv = append(rv, c)
+		}
+	}
+	return rv
+}
+
+// SetResponse sets the value returned for a command, e.g. the entries for
+// a message center getEntries command. Commands without a response set
+// return "1".
+func (s *Server) SetResponse(cmd string, value interface{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.responses[cmd] = value
+}
+
+// SetResponseDelay delays the response to a command, as a busy Miniserver
+// would. Status updates are still sent while the response is delayed.
+func (s *Server) SetResponseDelay(cmd string, delay time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.delays[cmd] = delay
+}
+
+// Commands returns every jdev/sps/io command received so far.
+func (s *Server) Commands() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+// WaitCommand waits for the next jdev/sps/io command to be received.
+func (s *Server) WaitCommand(timeout time.Duration) (string, error) {
+	select {
+	case cmd := <-s.commandCh:
+		return cmd, nil
+	case <-time.After(timeout):
+		return "", fmt.Errorf("No command received within %s", timeout)
+	}
+}
+
+func (s *Server) handleAPIKey(w http.ResponseWriter, r *http.Request) {
+	value := fmt.Sprintf("{'snr': '%s', 'version': '%s', 'key': '%x', 'isInTrust': false, 'local': true}",
+		s.Serial, s.Version, s.hashKey)
+	writeLL(w, "dev/cfg/apiKey", value, 200)
+}
+
+func (s *Server) handlePublicKey(w http.ResponseWriter, r *http.Request) {
+	der, err := x509.MarshalPKIXPublicKey(&s.privateKey.PublicKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	value := "-----BEGIN CERTIFICATE-----" + base64.StdEncoding.EncodeToString(der) + "-----END CERTIFICATE-----"
+	writeLL(w, "dev/sys/getPublicKey", value, 200)
+}
+
+func writeLL(w http.ResponseWriter, control string, value interface{}, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(llMessage(control, value, code))
+}
+
+func llMessage(control string, value interface{}, code int) map[string]interface{} {
+	return map[string]interface{}{"LL": map[string]interface{}{
+		"control": control,
+		"value":   value,
+		"Code":    fmt.Sprintf("%d", code),
+	}}
+}
+
+var upgrader = websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
+
+func (s *Server) handleWebsocket(w http.ResponseWriter, r *http.Request) {
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("fakeminiserver: websocket upgrade failed: %s", err)
+		return
+	}
+	c := &wsConn{ws: ws, server: s}
+	s.lock.Lock()
+	s.conns[c] = true
+	s.lock.Unlock()
+
+	defer func() {
+		s.lock.Lock()
+		delete(s.conns, c)
+		s.lock.Unlock()
+		ws.Close()
+	}()
+	for {
+		_, msg, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		if err := c.handle(string(msg)); err != nil {
+			log.Printf("fakeminiserver: %s", err)
+			return
+		}
+	}
+}
+
+func (s *Server) recordCommand(cmd string) interface{} {
+	s.lock.Lock()
+	s.commands = append(s.commands, cmd)
+	value, ck := s.responses[cmd]
+	delay := s.delays[cmd]
+	s.lock.Unlock()
+	select {
+	case s.commandCh <- cmd:
+	default:
+	}
+	time.Sleep(delay)
+	if !ck {
+		return "1"
+	}
+	return value
+}
+
+func (s *Server) newToken() string {
+	buf := make([]byte, 32)
+	rand.Read(buf)
+	token := base64.RawURLEncoding.EncodeToString(buf)
+	s.lock.Lock()
+	s.tokens[token] = true
+	s.lock.Unlock()
+	return token
+}
+
+func (s *Server) tokenValues() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var rv []string
+	for token := range s.tokens {
+		rv = append(rv, token)
+	}
+	return rv
+}
+
+func (s *Server) stateSnapshot() (map[uuid.UUID]float64, map[uuid.UUID]string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	values := make(map[uuid.UUID]float64, len(s.values))
+	for uu, v := range s.values {
+		values[uu] = v
+	}
+	texts := make(map[uuid.UUID]string, len(s.texts))
+	for uu, v := range s.texts {
+		texts[uu] = v
+	}
+	return values, texts
+}
+
+func parseUUID(uuidStr string) (uuid.UUID, error) {
+	return uuid.Parse(strings.ReplaceAll(uuidStr, "-", ""))
+}
@@ -0,0 +1,82 @@
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+)
+
+/* A handler for outputs that take a message and a flat list of fields,
+ * i.e. syslog and journald. Groups become prefixes of the field names.
+ */
+type fieldHandler struct {
+	emit   func(level slog.Level, msg string, attrs []slog.Attr) error
+	attrs  []slog.Attr
+	prefix string
+}
+
+func (h *fieldHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return true
+}
+
+func (h *fieldHandler) Handle(ctx context.Context, r slog.Record) error {
+	attrs := append([]slog.Attr(nil), h.attrs...)
+	r.Attrs(func(a slog.Attr) bool {
+		attrs = appendFlat(attrs, h.prefix, a)
+		return true
+	})
+	return h.emit(r.Level, r.Message, attrs)
+}
+
+func (h *fieldHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	nh := *h
+	nh.attrs = append([]slog.Attr(nil), h.attrs...)
+	for _, a := range attrs {
+		nh.attrs = appendFlat(nh.attrs, h.prefix, a)
+	}
+	return &nh
+}
+
+func (h *fieldHandler) WithGroup(name string) slog.Handler {
+	nh := *h
+	nh.prefix = h.prefix + name + "."
+	return &nh
+}
+
+func appendFlat(attrs []slog.Attr, prefix string, a slog.Attr) []slog.Attr {
+	a.Value = a.Value.Resolve()
+	if a.Value.Kind() != slog.KindGroup {
+		if a.Key == "" {
+			return attrs
+		}
+		return append(attrs, slog.Attr{Key: prefix + a.Key, Value: a.Value})
+	}
+	if len(a.Key) > 0 {
+		prefix += a.Key + "."
+	}
+	for _, ga := range a.Value.Group() {
+		attrs = appendFlat(attrs, prefix, ga)
+	}
+	return attrs
+}
+
+/* The message followed by the fields as key=value, for syslog. */
+func formatLine(msg string, attrs []slog.Attr) string {
+	var sb strings.Builder
+	sb.WriteString(msg)
+	for _, a := range attrs {
+		sb.WriteByte(' ')
+		sb.WriteString(a.Key)
+		sb.WriteByte('=')
+		val := a.Value.String()
+		if strings.ContainsAny(val, " \t\n\"=") || len(val) == 0 {
+			val = quote(val)
+		}
+		sb.WriteString(val)
+	}
+	return sb.String()
+}
+
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
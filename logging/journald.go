@@ -0,0 +1,96 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+)
+
+const journaldSocket = "/run/systemd/journal/socket"
+
+/* Sends records to journald using its native protocol, so that each
+ * attribute becomes a journal field, e.g. SUBSYSTEM=websocket, that can be
+ * used with journalctl.
+ */
+type journaldHandler struct {
+	fieldHandler
+	conn *net.UnixConn
+	lock sync.Mutex
+}
+
+func newJournaldHandler() (*journaldHandler, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journaldSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	h := &journaldHandler{conn: conn}
+	h.emit = h.write
+	return h, nil
+}
+
+func (h *journaldHandler) write(level slog.Level, msg string, attrs []slog.Attr) error {
+	var buf bytes.Buffer
+	journaldField(&buf, "MESSAGE", msg)
+	journaldField(&buf, "PRIORITY", journaldPriority(level))
+	journaldField(&buf, "SYSLOG_IDENTIFIER", "halox")
+	for _, a := range attrs {
+		if name := journaldName(a.Key); len(name) > 0 {
+			journaldField(&buf, name, a.Value.String())
+		}
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	_, err := h.conn.Write(buf.Bytes())
+	return err
+}
+
+func (h *journaldHandler) close() error {
+	return h.conn.Close()
+}
+
+func journaldPriority(level slog.Level) string {
+	switch {
+	case level >= slog.LevelError:
+		return "3"
+	case level >= slog.LevelWarn:
+		return "4"
+	case level >= slog.LevelInfo:
+		return "6"
+	}
+	return "7"
+}
+
+/* Field names may only contain upper case letters, digits and underscores
+ * and may not start with an underscore, which is reserved for fields added
+ * by journald.
+ */
+func journaldName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, key)
+	return strings.TrimLeft(name, "_0123456789")
+}
+
+/* Values containing a newline are sent as the name, a newline, the length
+ * as a little endian uint64 and the value.
+ */
+func journaldField(buf *bytes.Buffer, name, value string) {
+	buf.WriteString(name)
+	if strings.Contains(value, "\n") {
+		buf.WriteByte('\n')
+		binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	} else {
+		buf.WriteByte('=')
+	}
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
@@ -0,0 +1,159 @@
+// Package logging configures structured, leveled logging for halox using
+// log/slog. Levels can be set for each subsystem, given by the "subsystem"
+// attribute of a logger, and secrets such as keys, tokens and passwords
+// are redacted before anything is written.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+/* The logging section of the configuration file. Output goes to journald,
+ * syslog, the file or stderr, in that order of preference.
+ */
+type Config struct {
+	File     string
+	Syslog   bool
+	Journald bool
+	// debug, info, warn or error, info by default.
+	Level string
+	// text or json, text by default. Not used for syslog or journald.
+	Format string
+	// Levels for individual subsystems, e.g. websocket: warn.
+	Levels map[string]string
+}
+
+/* Create the handler described by the configuration and make it the
+ * default for slog and the log package. The returned function closes the
+ * output.
+ */
+func Setup(cfg Config) (func() error, error) {
+	h, closer, err := NewHandler(cfg)
+	if err != nil {
+		return nil, err
+	}
+	slog.SetDefault(slog.New(h))
+	return closer, nil
+}
+
+/* Create the handler described by the configuration without installing
+ * it.
+ */
+func NewHandler(cfg Config) (slog.Handler, func() error, error) {
+	level, err := ParseLevel(cfg.Level)
+	if err != nil {
+		return nil, nil, err
+	}
+	levels := make(map[string]slog.Level)
+	for subsystem, name := range cfg.Levels {
+		if levels[subsystem], err = ParseLevel(name); err != nil {
+			return nil, nil, fmt.Errorf("Invalid level for %s: %s", subsystem, err)
+		}
+	}
+
+	var inner slog.Handler
+	closer := func() error { return nil }
+	switch {
+	case cfg.Journald:
+		jh, err := newJournaldHandler()
+		if err != nil {
+			return nil, nil, err
+		}
+		inner, closer = jh, jh.close
+	case cfg.Syslog:
+		sh, err := newSyslogHandler()
+		if err != nil {
+			return nil, nil, err
+		}
+		inner, closer = sh, sh.close
+	default:
+		var w io.Writer = os.Stderr
+		if len(cfg.File) > 0 {
+			file, err := os.OpenFile(cfg.File, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+			if err != nil {
+				return nil, nil, fmt.Errorf("Unable to open log file %s to use: %s", cfg.File, err)
+			}
+			w, closer = file, file.Close
+		}
+		if inner, err = newStreamHandler(w, cfg.Format); err != nil {
+			return nil, nil, err
+		}
+	}
+	return &handler{inner: inner, level: level, defaultLevel: level, levels: levels}, closer, nil
+}
+
+func newStreamHandler(w io.Writer, format string) (slog.Handler, error) {
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+	switch strings.ToLower(format) {
+	case "", "text":
+		return slog.NewTextHandler(w, opts), nil
+	case "json":
+		return slog.NewJSONHandler(w, opts), nil
+	}
+	return nil, fmt.Errorf("Unknown log format '%s', expected text or json", format)
+}
+
+/* Parse a level name, which may be empty for info. */
+func ParseLevel(name string) (slog.Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("Unknown log level '%s', expected debug, info, warn or error", name)
+}
+
+/* Applies the level for the subsystem of the logger and redacts secrets
+ * before passing records to the output handler.
+ */
+type handler struct {
+	inner        slog.Handler
+	level        slog.Level
+	defaultLevel slog.Level
+	levels       map[string]slog.Level
+}
+
+func (h *handler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	clean := slog.NewRecord(r.Time, r.Level, redactString(r.Message), r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		clean.AddAttrs(redact(a))
+		return true
+	})
+	return h.inner.Handle(ctx, clean)
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	nh := *h
+	clean := make([]slog.Attr, len(attrs))
+	for n, a := range attrs {
+		clean[n] = redact(a)
+		if a.Key == "subsystem" {
+			nh.level = h.defaultLevel
+			if level, ck := h.levels[a.Value.String()]; ck {
+				nh.level = level
+			}
+		}
+	}
+	nh.inner = h.inner.WithAttrs(clean)
+	return &nh
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	nh := *h
+	nh.inner = h.inner.WithGroup(name)
+	return &nh
+}
@@ -0,0 +1,76 @@
+package logging
+
+import (
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+const redacted = "[REDACTED]"
+
+/* Attributes whose key contains any of these are never logged. */
+var secretKeys = []string{"password", "passwd", "token", "secret", "key", "salt", "hash"}
+
+var secretPatterns = []struct {
+	re          *regexp.Regexp
+	replacement string
+}{
+	// Loxone commands carrying hashes, keys or tokens, and the encrypted
+	// form of any command.
+	{regexp.MustCompile(`((?:jdev|dev)/sys/(?:getjwt|gettoken|refreshjwt|checktoken|authwithtoken|killtoken|keyexchange|getkey2|enc|fenc)/)[^\s"']+`),
+		"${1}" + redacted},
+	// JSON fields, e.g. in the response to getkey2 or getjwt.
+	{regexp.MustCompile(`(?i)("(?:[a-z_]*(?:token|key|salt|password|secret))"\s*:\s*)"[^"]*"`),
+		`${1}"` + redacted + `"`},
+	// key=value pairs.
+	{regexp.MustCompile(`(?i)\b((?:[a-z_]*(?:token|password|secret)|aes[ _-]?key|aes[ _-]?iv)\s*[=:]\s*)[^\s,]+`),
+		"${1}" + redacted},
+	// JSON web tokens.
+	{regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`), redacted},
+	// Credentials in URLs.
+	{regexp.MustCompile(`(://[^/\s:@]+:)[^/\s@]+@`), "${1}" + redacted + "@"},
+}
+
+func secretKey(key string) bool {
+	key = strings.ToLower(key)
+	if key == "iv" || strings.HasSuffix(key, "_iv") {
+		return true
+	}
+	for _, secret := range secretKeys {
+		if strings.Contains(key, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+/* Remove anything that looks like a secret from a string. */
+func redactString(s string) string {
+	for _, p := range secretPatterns {
+		s = p.re.ReplaceAllString(s, p.replacement)
+	}
+	return s
+}
+
+func redact(a slog.Attr) slog.Attr {
+	if secretKey(a.Key) {
+		return slog.String(a.Key, redacted)
+	}
+	switch a.Value.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, redactString(a.Value.String()))
+	case slog.KindGroup:
+		attrs := a.Value.Group()
+		clean := make([]slog.Attr, len(attrs))
+		for n, ga := range attrs {
+			clean[n] = redact(ga)
+		}
+		return slog.Attr{Key: a.Key, Value: slog.GroupValue(clean...)}
+	case slog.KindAny, slog.KindLogValuer:
+		if err, ck := a.Value.Resolve().Any().(error); ck {
+			return slog.String(a.Key, redactString(err.Error()))
+		}
+		return slog.Attr{Key: a.Key, Value: a.Value.Resolve()}
+	}
+	return a
+}
@@ -0,0 +1,31 @@
+package logging
+
+import (
+	"log/slog"
+	"sync"
+)
+
+/* Loggers for each subsystem, keyed by name, along with the default logger
+ * they were built from.
+ */
+var subsystems sync.Map
+
+type subsystemLogger struct {
+	base   *slog.Logger
+	logger *slog.Logger
+}
+
+/* The logger for a subsystem, built from the default slog logger with the
+ * subsystem attribute used for its level. It is rebuilt once the default
+ * is replaced, e.g. by Setup, so packages can log before the configuration
+ * is read.
+ */
+func Subsystem(name string) *slog.Logger {
+	base := slog.Default()
+	if sl, ck := subsystems.Load(name); ck && sl.(subsystemLogger).base == base {
+		return sl.(subsystemLogger).logger
+	}
+	l := base.With("subsystem", name)
+	subsystems.Store(name, subsystemLogger{base, l})
+	return l
+}
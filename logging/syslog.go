@@ -0,0 +1,40 @@
+//go:build !windows && !plan9
+
+package logging
+
+import (
+	"log/slog"
+	"log/syslog"
+)
+
+type syslogHandler struct {
+	fieldHandler
+	w *syslog.Writer
+}
+
+func newSyslogHandler() (*syslogHandler, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "halox")
+	if err != nil {
+		return nil, err
+	}
+	h := &syslogHandler{w: w}
+	h.emit = h.write
+	return h, nil
+}
+
+func (h *syslogHandler) write(level slog.Level, msg string, attrs []slog.Attr) error {
+	line := formatLine(msg, attrs)
+	switch {
+	case level >= slog.LevelError:
+		return h.w.Err(line)
+	case level >= slog.LevelWarn:
+		return h.w.Warning(line)
+	case level >= slog.LevelInfo:
+		return h.w.Info(line)
+	}
+	return h.w.Debug(line)
+}
+
+func (h *syslogHandler) close() error {
+	return h.w.Close()
+}
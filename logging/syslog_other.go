@@ -0,0 +1,17 @@
+//go:build windows || plan9
+
+package logging
+
+import "fmt"
+
+type syslogHandler struct {
+	fieldHandler
+}
+
+func newSyslogHandler() (*syslogHandler, error) {
+	return nil, fmt.Errorf("Syslog is not supported on this platform")
+}
+
+func (h *syslogHandler) close() error {
+	return nil
+}
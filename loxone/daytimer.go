@@ -0,0 +1,67 @@
+package loxone
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/zathras777/halox/logging"
+)
+
+const (
+	daytimerHeaderSize = 28
+	daytimerEntrySize  = 24
+)
+
+/* The schedule of a daytimer, as sent in a daytimer state update. Entries
+ * apply in the operating mode given, between From and To, which are
+ * minutes since midnight. Outside of any entry the daytimer has its
+ * default value.
+ */
+type Daytimer struct {
+	Default float64         `json:"default"`
+	Entries []DaytimerEntry `json:"entries"`
+}
+
+type DaytimerEntry struct {
+	Mode         int     `json:"mode"`
+	From         int     `json:"from"`
+	To           int     `json:"to"`
+	NeedActivate bool    `json:"need_activate"`
+	Value        float64 `json:"value"`
+}
+
+/* Each daytimer state is the UUID, the default value as a float64 and the
+ * number of entries, followed by the entries. An entry is the mode, from,
+ * to and need activate flag as int32 values and the value as a float64.
+ */
+func (s *Structure) parseDaytimerState(state []byte) (events []StateEvent) {
+	for n := 0; n+daytimerHeaderSize <= len(state); {
+		uu, err := stateUUID(state[n:])
+		if err != nil {
+			logging.Subsystem("states").Error("Error reading UUID", "position", n, "error", err)
+			break
+		}
+		dt := Daytimer{Default: math.Float64frombits(binary.LittleEndian.Uint64(state[n+16:]))}
+		count := int(binary.LittleEndian.Uint32(state[n+24:]))
+		n += daytimerHeaderSize
+		if n+count*daytimerEntrySize > len(state) {
+			logging.Subsystem("states").Error("Daytimer state is truncated", "uuid", uu)
+			break
+		}
+		for i := 0; i < count; i++ {
+			dt.Entries = append(dt.Entries, DaytimerEntry{
+				Mode:         int(int32(binary.LittleEndian.Uint32(state[n:]))),
+				From:         int(int32(binary.LittleEndian.Uint32(state[n+4:]))),
+				To:           int(int32(binary.LittleEndian.Uint32(state[n+8:]))),
+				NeedActivate: binary.LittleEndian.Uint32(state[n+12:]) != 0,
+				Value:        math.Float64frombits(binary.LittleEndian.Uint64(state[n+16:])),
+			})
+			n += daytimerEntrySize
+		}
+		logging.Subsystem("states").Debug("Daytimer state", "uuid", uu, "entries", len(dt.Entries))
+		if ev, ck := s.update(uu, dt); ck {
+			events = append(events, ev)
+		}
+	}
+	return
+}
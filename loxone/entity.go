@@ -0,0 +1,243 @@
+package loxone
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/zathras777/halox/logging"
+)
+
+/* A control from the structure file, or one of the pseudo controls for the
+ * global states, message center and weather server. Values holds the last
+ * value received for each state, keyed by state name.
+ */
+type Entity struct {
+	UUID       uuid.UUID
+	ActionUUID uuid.UUID
+	Name       string
+	Type       string
+	Room       string
+	RoomID     string
+	Category   string
+	States     map[string]uuid.UUID
+	Details    map[string]interface{}
+	Values     map[string]interface{}
+
+	// Unknown operating modes already warned about, for the global states.
+	unknownModes *sync.Map
+}
+
+/* A copy of the entity whose values are not changed by later updates. The
+ * other maps are only filled from the structure file, so are shared.
+ */
+func (le *Entity) snapshot() *Entity {
+	cp := *le
+	cp.Values = make(map[string]interface{}, len(le.Values))
+	for name, value := range le.Values {
+		cp.Values[name] = value
+	}
+	return &cp
+}
+
+/* Parse a UUID as written by Loxone, which has the last two groups joined,
+ * e.g. 10000001-0000-0001-ffff000000000001.
+ */
+func ParseUUID(uuidStr string) (uu uuid.UUID, err error) {
+	return uuid.Parse(strings.ReplaceAll(uuidStr, "-", ""))
+}
+
+/* Format a UUID the way Loxone does, as used in commands. */
+func UUIDString(uu uuid.UUID) string {
+	uStr := fmt.Sprintf("%s", uu)
+	lI := strings.LastIndex(uStr, "-")
+	return uStr[:lI] + uStr[lI+1:]
+}
+
+func newEntity(uuidStr string, data map[string]interface{}) Entity {
+	uu, err := ParseUUID(uuidStr)
+	if err != nil {
+		logging.Subsystem("loxone").Warn("Unable to parse UUID", "uuid", uuidStr, "error", err)
+	}
+	uua, err := ParseUUID(data["uuidAction"].(string))
+	if err != nil {
+		logging.Subsystem("loxone").Warn("Unable to parse action UUID", "uuid", data["uuidAction"], "error", err)
+	}
+
+	le := Entity{
+		UUID: uu, Name: data["name"].(string), Type: data["type"].(string), ActionUUID: uua}
+	le.Details, _ = data["details"].(map[string]interface{})
+	le.States = make(map[string]uuid.UUID)
+	le.Values = make(map[string]interface{})
+	for st, uus := range data["states"].(map[string]interface{}) {
+		uut, err := ParseUUID(uus.(string))
+		if err != nil {
+			logging.Subsystem("loxone").Warn("Invalid state UUID", "control", uuidStr, "state", st, "uuid", uus, "error", err)
+			continue
+		}
+		le.States[st] = uut
+	}
+	return le
+}
+
+/* Return the name of the room or category with the given UUID from the
+ * matching section of the structure file.
+ */
+func structureName(structure map[string]interface{}, section string, uuidStr interface{}) string {
+	items, ck := structure[section].(map[string]interface{})
+	if !ck {
+		return ""
+	}
+	key, ck := uuidStr.(string)
+	if !ck {
+		return ""
+	}
+	item, ck := items[key].(map[string]interface{})
+	if !ck {
+		return ""
+	}
+	name, _ := item["name"].(string)
+	return name
+}
+
+/* Commands accepted for controls that understand more than the generic
+ * On/Off. Commands ending in / take a single argument, e.g. on/1.
+ */
+var loxoneCommands = map[string][]string{
+	"Pushbutton":    {"pulse", "on", "off"},
+	"TimedSwitch":   {"pulse", "on", "off"},
+	"Gate":          {"open", "close", "stop"},
+	"CentralGate":   {"open", "close", "stop"},
+	"Alarm":         {"on", "on/", "off", "delayedon", "delayedon/", "quit", "dismv/"},
+	"SmokeAlarm":    {"mute", "quit", "servicemode/"},
+	"GlobalStates":  {},
+	"MessageCenter": {"confirm/", "delete/"},
+	"WeatherServer": {},
+	"AudioZone":     audioZoneCommands,
+	"AudioZoneV2":   audioZoneCommands,
+}
+
+var audioZoneCommands = []string{"play", "pause", "stop", "prev", "next", "on", "off",
+	"volume/", "source/", "shuffle/", "repeat/"}
+
+/* Commands accepted for any other control, along with a numeric value. */
+var genericCommands = []string{"on", "off", "pulse"}
+
+/* Return the command to send to the Miniserver for a requested action, as
+ * received on an MQTT action topic. 1.000000 and 0.000000 are On and Off.
+ * For controls with a known set of commands anything else has to be one of
+ * them, otherwise it has to be one of the generic commands or a number.
+ */
+func (le Entity) Command(val []byte) (string, error) {
+	cmdVal := string(val)
+	switch cmdVal {
+	case "1.000000":
+		cmdVal = "On"
+	case "0.000000":
+		cmdVal = "Off"
+	}
+	allowed := true
+	if cmds, ck := loxoneCommands[le.Type]; ck {
+		cmdVal = strings.ToLower(cmdVal)
+		allowed = commandAllowed(cmds, cmdVal)
+	} else if number, err := strconv.ParseFloat(cmdVal, 64); err == nil {
+		cmdVal = strconv.FormatFloat(number, 'f', -1, 64)
+		allowed = !math.IsNaN(number) && !math.IsInf(number, 0)
+	} else {
+		allowed = commandAllowed(genericCommands, strings.ToLower(cmdVal))
+	}
+	if !allowed {
+		return "", fmt.Errorf("Command '%s' is not valid for %s control %s", val, le.Type, le.Name)
+	}
+	return fmt.Sprintf("jdev/sps/io/%s/%s", UUIDString(le.ActionUUID), cmdVal), nil
+}
+
+func commandAllowed(cmds []string, cmd string) bool {
+	for _, c := range cmds {
+		if c == cmd {
+			return true
+		}
+		if strings.HasSuffix(c, "/") && strings.HasPrefix(cmd, c) {
+			arg := cmd[len(c):]
+			if len(arg) > 0 && !strings.Contains(arg, "/") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (le Entity) StateName(uu uuid.UUID) string {
+	for name, stateuu := range le.States {
+		if stateuu == uu {
+			return name
+		}
+	}
+	return ""
+}
+
+/* The structure file gives the format for the value state of an info
+ * control as details.format and for other states as details.<state>Format,
+ * e.g. details.actualFormat for a Meter.
+ */
+func (le Entity) StateFormat(name string) string {
+	if name == "value" {
+		if format, ck := le.Details["format"].(string); ck {
+			return format
+		}
+	}
+	if format, ck := le.Details[name+"Format"].(string); ck {
+		return format
+	}
+	return ""
+}
+
+/* Return the unit for a state, either from the format given in the
+ * structure file or, for controls that have fixed units, from
+ * defaultStateUnits.
+ */
+func (le Entity) StateUnit(name string) string {
+	if format := le.StateFormat(name); len(format) > 0 {
+		return FormatUnit(format)
+	}
+	return defaultStateUnits[le.Type][name]
+}
+
+var defaultStateUnits = map[string]map[string]string{
+	"Fronius": {
+		"prodCurr":      "kW",
+		"prodCurrDay":   "kWh",
+		"prodCurrMonth": "kWh",
+		"prodCurrYear":  "kWh",
+		"prodTotal":     "kWh",
+		"consCurr":      "kW",
+		"consCurrDay":   "kWh",
+		"gridCurr":      "kW",
+		"batteryCurr":   "kW",
+		"stateOfCharge": "%",
+	},
+	"EnergyManager2": {
+		"Gpwr":   "kW",
+		"Ppwr":   "kW",
+		"Spwr":   "kW",
+		"Ssoc":   "%",
+		"MinSoc": "%",
+	},
+}
+
+func (le Entity) TextValue(name string) string {
+	if val, ck := le.Values[name].(string); ck {
+		return val
+	}
+	return ""
+}
+
+func (le Entity) FloatValue(name string) float64 {
+	if val, ck := le.Values[name].(float64); ck {
+		return val
+	}
+	return 0
+}
@@ -0,0 +1,244 @@
+package loxone
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/zathras777/halox/logging"
+)
+
+const defaultSubscriberBuffer = 100
+
+/* What happens when a subscriber's buffer is full. DropOldest discards the
+ * oldest event waiting to make room for the new one, DropNewest discards
+ * the new event, Block waits until the subscriber has room, holding up
+ * every other subscriber and the status updates, and Disconnect closes the
+ * subscriber's channel.
+ */
+type SlowPolicy int
+
+const (
+	DropOldest SlowPolicy = iota
+	DropNewest
+	Block
+	Disconnect
+)
+
+/* Selects the events delivered to a subscriber. Controls are matched by
+ * UUID, action UUID or name, rooms by name. An empty list matches
+ * everything, so the zero EventFilter matches every event.
+ */
+type EventFilter struct {
+	Controls []string
+	Types    []string
+	Rooms    []string
+	States   []string
+}
+
+type subscriber struct {
+	filter EventFilter
+	policy SlowPolicy
+	ch     chan StateEvent
+
+	// Closed on Unsubscribe so that a blocked delivery gives up.
+	done     chan struct{}
+	doneOnce sync.Once
+
+	lock    sync.Mutex
+	closed  bool
+	dropped uint64
+}
+
+/* Subscribers to the events of a Structure. */
+type eventHub struct {
+	lock        sync.Mutex
+	subscribers map[<-chan StateEvent]*subscriber
+	dropped     uint64
+}
+
+/* Return a channel receiving every event matching the filter, decoded by
+ * Update, with room for 100 events and the DropOldest policy. Each
+ * subscriber receives its own copy of the events, and the entity of an
+ * event is a snapshot taken after the update that later updates leave
+ * alone, so it can be read on any goroutine.
+ */
+func (s *Structure) Subscribe(filter EventFilter) <-chan StateEvent {
+	return s.SubscribeBuffered(filter, defaultSubscriberBuffer, DropOldest)
+}
+
+/* As Subscribe, with the buffer size and the policy applied when the
+ * buffer is full.
+ */
+func (s *Structure) SubscribeBuffered(filter EventFilter, size int, policy SlowPolicy) <-chan StateEvent {
+	if size < 0 {
+		size = 0
+	}
+	sub := &subscriber{filter: filter, policy: policy,
+		ch: make(chan StateEvent, size), done: make(chan struct{})}
+	s.events.lock.Lock()
+	defer s.events.lock.Unlock()
+	if s.events.subscribers == nil {
+		s.events.subscribers = make(map[<-chan StateEvent]*subscriber)
+	}
+	s.events.subscribers[sub.ch] = sub
+	return sub.ch
+}
+
+/* Stop delivering events to a channel returned by Subscribe and close it. */
+func (s *Structure) Unsubscribe(ch <-chan StateEvent) {
+	s.events.lock.Lock()
+	sub, ck := s.events.subscribers[ch]
+	delete(s.events.subscribers, ch)
+	s.events.lock.Unlock()
+	if ck {
+		sub.close()
+	}
+}
+
+/* The number of events dropped because subscribers were too slow. */
+func (s *Structure) Dropped() uint64 {
+	return atomic.LoadUint64(&s.events.dropped)
+}
+
+func (hub *eventHub) publish(events []StateEvent) {
+	if len(events) == 0 {
+		return
+	}
+	hub.lock.Lock()
+	subs := make([]*subscriber, 0, len(hub.subscribers))
+	for _, sub := range hub.subscribers {
+		subs = append(subs, sub)
+	}
+	hub.lock.Unlock()
+	if len(subs) == 0 {
+		return
+	}
+
+	// Subscribers read the events on their own goroutines while later
+	// updates are applied, so they get a copy of each entity.
+	snapshots := make(map[*Entity]*Entity)
+	shared := make([]StateEvent, len(events))
+	for n, ev := range events {
+		if _, ck := snapshots[ev.Entity]; !ck {
+			snapshots[ev.Entity] = ev.Entity.snapshot()
+		}
+		ev.Entity = snapshots[ev.Entity]
+		shared[n] = ev
+	}
+
+	for _, sub := range subs {
+		for _, ev := range shared {
+			if !sub.filter.matches(ev) {
+				continue
+			}
+			if !sub.deliver(ev) {
+				atomic.AddUint64(&hub.dropped, 1)
+			}
+			if sub.policy == Disconnect && sub.isClosed() {
+				hub.lock.Lock()
+				delete(hub.subscribers, sub.ch)
+				hub.lock.Unlock()
+				break
+			}
+		}
+	}
+}
+
+/* Deliver an event according to the subscriber's policy, returning false
+ * if it was dropped.
+ */
+func (sub *subscriber) deliver(ev StateEvent) bool {
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+	if sub.closed {
+		return false
+	}
+	select {
+	case sub.ch <- ev:
+		return true
+	default:
+	}
+
+	switch sub.policy {
+	case DropNewest:
+	case DropOldest:
+		select {
+		case <-sub.ch:
+		default:
+		}
+		select {
+		case sub.ch <- ev:
+		default:
+		}
+	case Block:
+		// Unsubscribe closes done before taking the lock, so this cannot
+		// deadlock with it.
+		select {
+		case sub.ch <- ev:
+			return true
+		case <-sub.done:
+			return false
+		}
+	case Disconnect:
+		logging.Subsystem("states").Warn("Subscriber is too slow, disconnecting it")
+		sub.doneOnce.Do(func() { close(sub.done) })
+		close(sub.ch)
+		sub.closed = true
+		return false
+	}
+	sub.dropped++
+	if sub.dropped == 1 || sub.dropped%1000 == 0 {
+		logging.Subsystem("states").Warn("Subscriber is too slow, events dropped", "dropped", sub.dropped)
+	}
+	return false
+}
+
+func (sub *subscriber) isClosed() bool {
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+	return sub.closed
+}
+
+func (sub *subscriber) close() {
+	sub.doneOnce.Do(func() { close(sub.done) })
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+	if !sub.closed {
+		close(sub.ch)
+		sub.closed = true
+	}
+}
+
+func (f EventFilter) matches(ev StateEvent) bool {
+	le := ev.Entity
+	if len(f.Types) > 0 && !containsString(f.Types, le.Type) {
+		return false
+	}
+	if len(f.Rooms) > 0 && !containsString(f.Rooms, le.Room) {
+		return false
+	}
+	if len(f.States) > 0 && !containsString(f.States, ev.State) {
+		return false
+	}
+	if len(f.Controls) == 0 {
+		return true
+	}
+	for _, ctl := range f.Controls {
+		if ctl == le.Name {
+			return true
+		}
+		if uu, err := ParseUUID(ctl); err == nil && (uu == le.UUID || uu == le.ActionUUID) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
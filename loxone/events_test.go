@@ -0,0 +1,164 @@
+package loxone
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/zathras777/halox/internal/fakeminiserver"
+)
+
+const heatingSchedule = "10000008-0000-0001-ffff000000000003"
+
+/* Apply status updates from the server until the test ends. */
+func runUpdates(t *testing.T, ls *Server, s *Structure) {
+	stop := make(chan struct{})
+	t.Cleanup(func() { close(stop) })
+	go func() {
+		for {
+			select {
+			case msg := <-ls.Updates():
+				s.Update(msg)
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+func waitForEvent(t *testing.T, ch <-chan StateEvent, match func(StateEvent) bool) StateEvent {
+	t.Helper()
+	deadline := time.After(updateDeadline)
+	for {
+		select {
+		case ev, ck := <-ch:
+			if !ck {
+				t.Fatal("Subscription closed")
+			}
+			if match(ev) {
+				return ev
+			}
+		case <-deadline:
+			t.Fatal("Expected event not received")
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	fake := fakeminiserver.Start(t)
+	ls, s := connectFakeMiniserver(t, fake)
+	temps := s.Subscribe(EventFilter{Controls: []string{"Outside Temperature"}})
+	daytimers := s.Subscribe(EventFilter{Types: []string{"Daytimer"}, States: []string{"entriesAndDefaultValue"}})
+	runUpdates(t, ls, s)
+	if err := ls.EnableUpdates(); err != nil {
+		t.Fatalf("EnableUpdates() failed: %s", err)
+	}
+
+	fake.SetValue(outsideTemp, 12.5)
+	ev := waitForEvent(t, temps, func(ev StateEvent) bool { return ev.Value == 12.5 })
+	if ev.Entity.Name != "Outside Temperature" || ev.Entity.Room != "Outside" || ev.State != "value" {
+		t.Errorf("Unexpected event %+v", ev)
+	}
+
+	entries := []fakeminiserver.DaytimerEntry{
+		{Mode: 3, From: 360, To: 1320, Value: 21},
+		{Mode: 4, From: 480, To: 1380, NeedActivate: true, Value: 22.5},
+	}
+	fake.SetDaytimer(heatingSchedule, 17, entries)
+	ev = waitForEvent(t, daytimers, func(ev StateEvent) bool {
+		_, ck := ev.Value.(Daytimer)
+		return ck
+	})
+	expected := Daytimer{Default: 17, Entries: []DaytimerEntry{
+		{Mode: 3, From: 360, To: 1320, Value: 21},
+		{Mode: 4, From: 480, To: 1380, NeedActivate: true, Value: 22.5},
+	}}
+	if !reflect.DeepEqual(ev.Value, expected) {
+		t.Errorf("Daytimer %+v, expected %+v", ev.Value, expected)
+	}
+	if ev.Entity.Name != "Heating Schedule" {
+		t.Errorf("Daytimer event for %s, expected Heating Schedule", ev.Entity.Name)
+	}
+
+	// Unsubscribing closes the channel once any pending events are read.
+	s.Unsubscribe(temps)
+	for range temps {
+	}
+}
+
+func TestSlowSubscribers(t *testing.T) {
+	var data map[string]interface{}
+	if err := json.Unmarshal(fakeminiserver.DefaultStructure(), &data); err != nil {
+		t.Fatal(err)
+	}
+	s := NewStructure(data, "504F94000001")
+	le := s.Controls[testUUID(t, "10000005-0000-0001-ffff000000000001")]
+
+	oldest := s.SubscribeBuffered(EventFilter{}, 2, DropOldest)
+	newest := s.SubscribeBuffered(EventFilter{}, 2, DropNewest)
+	disconnect := s.SubscribeBuffered(EventFilter{}, 2, Disconnect)
+	for n := 1; n <= 5; n++ {
+		s.events.publish([]StateEvent{{Entity: le, State: "value", Value: float64(n)}})
+	}
+
+	check := func(name string, ch <-chan StateEvent, expected ...float64) {
+		t.Helper()
+		for _, val := range expected {
+			if ev := <-ch; ev.Value != val {
+				t.Errorf("%s received %v, expected %v", name, ev.Value, val)
+			}
+		}
+	}
+	check("DropOldest", oldest, 4, 5)
+	check("DropNewest", newest, 1, 2)
+	check("Disconnect", disconnect, 1, 2)
+	if _, ck := <-disconnect; ck {
+		t.Error("Disconnected subscriber's channel is still open")
+	}
+	if dropped := s.Dropped(); dropped != 7 {
+		t.Errorf("%d events dropped, expected 7", dropped)
+	}
+
+	// A blocked delivery must give up when the subscriber unsubscribes.
+	s.Unsubscribe(oldest)
+	s.Unsubscribe(newest)
+	blocked := s.SubscribeBuffered(EventFilter{}, 0, Block)
+	published := make(chan struct{})
+	go func() {
+		s.events.publish([]StateEvent{{Entity: le, State: "value", Value: 6.0}})
+		close(published)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	s.Unsubscribe(blocked)
+	select {
+	case <-published:
+	case <-time.After(updateDeadline):
+		t.Fatal("Publish still blocked after unsubscribing")
+	}
+}
+
+func TestEventSnapshot(t *testing.T) {
+	var data map[string]interface{}
+	if err := json.Unmarshal(fakeminiserver.DefaultStructure(), &data); err != nil {
+		t.Fatal(err)
+	}
+	s := NewStructure(data, "504F94000001")
+	le := s.Controls[testUUID(t, "10000005-0000-0001-ffff000000000001")]
+	ch := s.SubscribeBuffered(EventFilter{}, 2, Block)
+
+	// Later updates must not change the values seen by the subscriber.
+	le.Values["value"] = 1.0
+	s.events.publish([]StateEvent{{Entity: le, State: "value", Value: 1.0}})
+	le.Values["value"] = 2.0
+	ev := <-ch
+	if ev.Entity == le {
+		t.Fatal("Subscriber received the entity from the structure")
+	}
+	if value := ev.Entity.FloatValue("value"); value != 1 {
+		t.Errorf("Snapshot value %v, expected 1", value)
+	}
+	if ev.Entity.Name != le.Name || ev.Entity.UUID != le.UUID {
+		t.Errorf("Snapshot of %s, expected %s", ev.Entity.Name, le.Name)
+	}
+}
@@ -0,0 +1,177 @@
+package loxone
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* Loxone formats are either printf style, e.g. "%.1f°C", or use the Loxone
+ * Config placeholders, e.g. "<v.1> kWh". An escaped %% is matched first so
+ * that in "%.1f%% rF" the "% r" is not taken for a verb.
+ */
+var formatSpecifier = regexp.MustCompile(`%%|%[-+ #0]*[0-9]*(\.[0-9]+)?[a-zA-Z]|<v(\.[a-z0-9]+)?>`)
+
+/* Return the unit from a Loxone format string, i.e. whatever is left once
+ * the value placeholder has been removed. A format with several printf
+ * verbs, e.g. "%02d:%02d", is a time and so has no unit.
+ */
+func FormatUnit(format string) string {
+	if printfVerbs(format) > 1 {
+		return ""
+	}
+	unit := formatSpecifier.ReplaceAllStringFunc(format, func(spec string) string {
+		if spec == "%%" {
+			return "%"
+		}
+		return ""
+	})
+	return strings.TrimSpace(unit)
+}
+
+/* Return true if the format renders the value as a date or time rather
+ * than a number.
+ */
+func FormatIsTime(format string) bool {
+	return strings.Contains(format, "<v.u>") || strings.Contains(format, "<v.d>") || printfVerbs(format) > 1
+}
+
+func printfVerbs(format string) int {
+	n := 0
+	for _, spec := range formatSpecifier.FindAllString(format, -1) {
+		if spec != "%%" && strings.HasPrefix(spec, "%") {
+			n++
+		}
+	}
+	return n
+}
+
+/* Whether the format has a verb or placeholder for the value. */
+func hasPlaceholder(format string) bool {
+	for _, spec := range formatSpecifier.FindAllString(format, -1) {
+		if spec != "%%" {
+			return true
+		}
+	}
+	return false
+}
+
+/* Render a value the way the Loxone app shows it. Besides printf verbs the
+ * following placeholders are understood:
+ *   <v>    value with as many decimals as required
+ *   <v.N>  value with N decimals
+ *   <v.u>  date and time, value is seconds since 2009-01-01
+ *   <v.d>  date, value is seconds since 2009-01-01
+ *   <v.t>  duration, value is in seconds
+ * Several printf verbs, e.g. "%02d:%02d", split the value into hours and
+ * minutes, or hours, minutes and seconds for three. A format without a
+ * placeholder is taken as the unit.
+ */
+func FormatValue(format string, value float64) string {
+	plain := strconv.FormatFloat(value, 'f', -1, 64)
+	if !hasPlaceholder(format) {
+		return strings.TrimSpace(plain + " " + FormatUnit(format))
+	}
+	parts := []float64{value}
+	sign := ""
+	if n := printfVerbs(format); n > 1 {
+		parts, sign = clockParts(value, n)
+	}
+	out := formatSpecifier.ReplaceAllStringFunc(format, func(spec string) string {
+		if spec == "%%" {
+			return "%"
+		}
+		if strings.HasPrefix(spec, "<") {
+			return formatPlaceholder(spec, value)
+		}
+		part := parts[0]
+		if len(parts) > 1 {
+			parts = parts[1:]
+		}
+		return formatPrintf(spec, part)
+	})
+	return sign + out
+}
+
+/* Split a value into n base 60 parts, most significant first, e.g. 90
+ * into 1 and 30, with the sign returned separately.
+ */
+func clockParts(value float64, n int) ([]float64, string) {
+	sign := ""
+	if value < 0 {
+		sign = "-"
+		value = -value
+	}
+	rest := int64(math.Round(value))
+	parts := make([]float64, n)
+	for i := n - 1; i > 0; i-- {
+		parts[i] = float64(rest % 60)
+		rest /= 60
+	}
+	parts[0] = float64(rest)
+	return parts, sign
+}
+
+func formatPrintf(spec string, value float64) string {
+	verb := spec[len(spec)-1]
+	switch verb {
+	case 'f', 'F', 'e', 'E', 'g', 'G':
+		return fmt.Sprintf(spec, value)
+	case 'd', 'i', 'u':
+		return fmt.Sprintf(spec[:len(spec)-1]+"d", int64(math.Round(value)))
+	case 'x', 'X', 'o':
+		return fmt.Sprintf(spec, int64(math.Round(value)))
+	}
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+func formatPlaceholder(spec string, value float64) string {
+	opt := strings.TrimSuffix(strings.TrimPrefix(spec, "<v"), ">")
+	switch opt {
+	case "":
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case ".u":
+		return Time(value).Format("2006-01-02 15:04")
+	case ".d":
+		return Time(value).Format("2006-01-02")
+	case ".t":
+		return formatDuration(value)
+	}
+	if decimals, err := strconv.Atoi(opt[1:]); err == nil {
+		return strconv.FormatFloat(value, 'f', decimals, 64)
+	}
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+/* Loxone times are seconds since 2009-01-01 in the Miniserver's local time,
+ * so the result is left in UTC to show the same wall clock time.
+ */
+func Time(value float64) time.Time {
+	return loxoneTimeBase.Add(time.Duration(value) * time.Second)
+}
+
+/* A Loxone time as the instant it refers to, given the zone the Miniserver
+ * is in.
+ */
+func TimeIn(value float64, loc *time.Location) time.Time {
+	t := Time(value)
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, loc)
+}
+
+func formatDuration(value float64) string {
+	sign := ""
+	if value < 0 {
+		sign = "-"
+		value = -value
+	}
+	secs := int64(math.Round(value))
+	days := secs / 86400
+	hms := fmt.Sprintf("%02d:%02d:%02d", (secs%86400)/3600, (secs%3600)/60, secs%60)
+	if days > 0 {
+		return fmt.Sprintf("%s%dd %s", sign, days, hms)
+	}
+	return sign + hms
+}
@@ -0,0 +1,79 @@
+package loxone
+
+import "testing"
+
+func TestFormatValue(t *testing.T) {
+	tests := []struct {
+		format string
+		value  float64
+		output string
+	}{
+		{"", 21.456, "21.456"},
+		{"%.1f°C", 21.46, "21.5°C"},
+		{"%d%%", 42.6, "43%"},
+		{"%.0f%%", 42.6, "43%"},
+		{"%.1f%% rF", 55.4, "55.4% rF"},
+		{"%.0f W", 1234.4, "1234 W"},
+		{"%x", 255, "ff"},
+		{"<v> kWh", 12.5, "12.5 kWh"},
+		{"<v.1> kWh", 12.345, "12.3 kWh"},
+		{"<v.t>", 3725, "01:02:05"},
+		{"<v.t>", 90061, "1d 01:01:01"},
+		{"<v.u>", 365*86400 + 8*3600 + 30*60, "2010-01-01 08:30"},
+		{"<v.d>", 365 * 86400, "2010-01-01"},
+		{"%02d:%02d", 405, "06:45"},
+		{"%02d:%02d:%02d", 3725, "01:02:05"},
+		{"%02d:%02d", -90, "-01:30"},
+		{"%s", 3.5, "3.5"},
+		{"kWh", 2, "2 kWh"},
+	}
+	for _, tc := range tests {
+		if output := FormatValue(tc.format, tc.value); output != tc.output {
+			t.Errorf("FormatValue(%q, %v) = %q, expected %q", tc.format, tc.value, output, tc.output)
+		}
+	}
+}
+
+func TestFormatUnit(t *testing.T) {
+	tests := []struct {
+		format string
+		unit   string
+	}{
+		{"", ""},
+		{"%.1f°C", "°C"},
+		{"%d%%", "%"},
+		{"%.0f%%", "%"},
+		{"%.1f%% rF", "% rF"},
+		{"%.3f kW", "kW"},
+		{"<v.1> kWh", "kWh"},
+		{"<v.t>", ""},
+		{"%02d:%02d", ""},
+		{"kWh", "kWh"},
+	}
+	for _, tc := range tests {
+		if unit := FormatUnit(tc.format); unit != tc.unit {
+			t.Errorf("FormatUnit(%q) = %q, expected %q", tc.format, unit, tc.unit)
+		}
+	}
+}
+
+func TestFormatIsTime(t *testing.T) {
+	tests := []struct {
+		format string
+		isTime bool
+	}{
+		{"", false},
+		{"%.1f°C", false},
+		{"%.0f%%", false},
+		{"%.1f%% rF", false},
+		{"<v.t>", false},
+		{"<v.u>", true},
+		{"<v.d>", true},
+		{"%02d:%02d", true},
+	}
+	for _, tc := range tests {
+		if isTime := FormatIsTime(tc.format); isTime != tc.isTime {
+			t.Errorf("FormatIsTime(%q) = %v, expected %v", tc.format, isTime, tc.isTime)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package loxone
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/zathras777/halox/logging"
+)
+
+/* The globalStates section of the structure file lists states that do not
+ * belong to any control, e.g. sunrise or the operating mode. These are
+ * gathered into a single entity so they are handled like any other
+ * control.
+ */
+func newGlobalEntity(structure map[string]interface{}, serial string) (le Entity, err error) {
+	globals, ck := structure["globalStates"].(map[string]interface{})
+	if !ck {
+		err = fmt.Errorf("Structure file has no globalStates")
+		return
+	}
+	uu := uuid.NewSHA1(uuid.NameSpaceOID, []byte("loxone-global-"+serial))
+	le = newEntity(UUIDString(uu), map[string]interface{}{
+		"name":       "Miniserver",
+		"type":       "GlobalStates",
+		"uuidAction": UUIDString(uu),
+		"states":     globals,
+	})
+	le.Details = map[string]interface{}{}
+	le.unknownModes = new(sync.Map)
+	if modes, ck := structure["operatingModes"].(map[string]interface{}); ck {
+		le.Details["operatingModes"] = modes
+	}
+	return
+}
+
+/* Translate an operating mode ID into its name from the structure file. An
+ * unknown mode is only warned about once, as the name is looked up on every
+ * update.
+ */
+func (le Entity) OperatingModeName(mode float64) string {
+	id := strconv.Itoa(int(mode))
+	if modes, ck := le.Details["operatingModes"].(map[string]interface{}); ck {
+		if name, ck := modes[id].(string); ck {
+			return name
+		}
+	}
+	if le.unknownModes == nil {
+		logging.Subsystem("loxone").Warn("Unknown operating mode", "mode", id)
+	} else if _, warned := le.unknownModes.LoadOrStore(id, true); !warned {
+		logging.Subsystem("loxone").Warn("Unknown operating mode", "mode", id)
+	}
+	return id
+}
@@ -0,0 +1,68 @@
+package loxone
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+/* The message center (system status) is described by the messageCenter
+ * section of the structure file. Its changed state is updated whenever an
+ * entry is added or changes, after which the entries have to be fetched.
+ */
+func newMessageCenterEntity(structure map[string]interface{}) (le Entity, err error) {
+	mc, ck := structure["messageCenter"].(map[string]interface{})
+	if !ck {
+		err = fmt.Errorf("Structure file has no messageCenter")
+		return
+	}
+	if _, ck := mc["uuidAction"].(string); !ck {
+		err = fmt.Errorf("Structure file messageCenter has no uuidAction")
+		return
+	}
+	states, _ := mc["states"].(map[string]interface{})
+	if states == nil {
+		states = map[string]interface{}{}
+	}
+	le = newEntity(mc["uuidAction"].(string), map[string]interface{}{
+		"name":       "Message Center",
+		"type":       "MessageCenter",
+		"uuidAction": mc["uuidAction"],
+		"states":     states,
+	})
+	return
+}
+
+type MessageEntry struct {
+	EntryUUID    string `json:"entryUuid"`
+	Title        string
+	Desc         string
+	SourceName   string
+	AffectedName string
+	AffectedUUID string `json:"affectedUuid"`
+	RoomUUID     string `json:"roomUuid"`
+	Severity     int
+	Timestamps   []int64
+	IsHistoric   bool
+	ConfirmedAt  int64
+}
+
+/* Fetch the entries from the message center, both active and historic. */
+func (ls *Server) MessageEntries(le *Entity) ([]MessageEntry, error) {
+	msg, err := ls.SendCommandResult(fmt.Sprintf("jdev/sps/io/%s/getEntries/2", UUIDString(le.ActionUUID)))
+	if err != nil {
+		return nil, err
+	}
+	var raw []byte
+	if str, ck := msg.LL.Value.(string); ck {
+		raw = []byte(str)
+	} else if raw, err = json.Marshal(msg.LL.Value); err != nil {
+		return nil, fmt.Errorf("Unable to decode message center entries: %s", err)
+	}
+	var entries struct {
+		Entries []MessageEntry
+	}
+	if err := json.Unmarshal(raw, &entries); err != nil {
+		return nil, fmt.Errorf("Unable to decode message center entries: %s", err)
+	}
+	return entries.Entries, nil
+}
@@ -1,4 +1,6 @@
-package main
+// Package loxone is a client for the Loxone Miniserver websocket API. It
+// handles authentication, the structure file, status updates and commands.
+package loxone
 
 import (
 	"bytes"
@@ -16,22 +18,32 @@ import (
 	"encoding/pem"
 	"fmt"
 	"hash"
-	"log"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/zathras777/halox/logging"
 )
 
-type loxoneServer struct {
+// Server is a connection to a single Miniserver.
+type Server struct {
 	address  string
 	userName string
 	passWord string
 
 	apiKey    string
+	serial    string
+	version   string
 	publicKey *rsa.PublicKey
-	ws        *lxWebsocket
+
+	// The websocket is replaced when reconnecting, so is only used through
+	// websocket().
+	wsLock         sync.Mutex
+	ws             *lxWebsocket
+	updatesEnabled bool
 
 	aesKey        []byte
 	aesIV         []byte
@@ -40,11 +52,11 @@ type loxoneServer struct {
 	salt    []byte
 	srvSalt []byte
 
-	token           string
-	tokenExpiration time.Time
+	token string
 
-	updatesEnabled bool
-	updateChannel  chan loxoneStatusMessage
+	updates chan StatusMessage
+
+	stats serverStats
 }
 
 var loxoneTimeBase time.Time = time.Date(2009, 01, 01, 0, 0, 0, 0, time.UTC)
@@ -55,14 +67,18 @@ func PKCS5Padding(ciphertext []byte, blockSize int) []byte {
 	return append(ciphertext, padtext...)
 }
 
-func newLoxoneServer(host string, port int, user, pw string) *loxoneServer {
-	return &loxoneServer{address: fmt.Sprintf("%s:%d", host, port),
+// NewServer returns a Server for the Miniserver at host:port. Nothing is
+// sent to the Miniserver until Connect is called.
+func NewServer(host string, port int, user, pw string) *Server {
+	return &Server{address: fmt.Sprintf("%s:%d", host, port),
 		userName: user,
-		passWord: pw}
+		passWord: pw,
+		updates:  make(chan StatusMessage, 10)}
 }
 
-/* Can be used for reconnections... */
-func (ls *loxoneServer) connect() error {
+// Connect authenticates with the Miniserver and opens the websocket used for
+// commands and status updates. It is also used to reconnect.
+func (ls *Server) Connect() error {
 	if len(ls.apiKey) == 0 {
 		if err := ls.getApiKey(); err != nil {
 			return fmt.Errorf("Unable to get server information from loxone @ %s: %s", ls.address, err)
@@ -73,10 +89,12 @@ func (ls *loxoneServer) connect() error {
 			return fmt.Errorf("Unable to get public key from Loxone @ %s: %s", ls.address, err)
 		}
 	}
+	ls.wsLock.Lock()
 	if ls.ws != nil {
 		ls.ws.ws.Close()
 		ls.ws = nil
 	}
+	ls.wsLock.Unlock()
 	if err := ls.openWebsocket(); err != nil {
 		return fmt.Errorf("Unable to open a websocket: %s", err)
 	}
@@ -86,19 +104,23 @@ func (ls *loxoneServer) connect() error {
 	if err := ls.getToken(); err != nil {
 		return err
 	}
-	go ls.serverMonitor()
-	if ls.updatesEnabled {
-		ls.enableUpdates()
+	ls.stats.update(func(s *ServerStats) { s.Connects++ })
+	ls.wsLock.Lock()
+	ws, updatesEnabled := ls.ws, ls.updatesEnabled
+	ls.wsLock.Unlock()
+	go ls.serverMonitor(ws)
+	if updatesEnabled {
+		ls.EnableUpdates()
 	}
-	log.Printf("Connected & authenticated with Loxone server @ %s", ls.address)
+	logging.Subsystem("loxone").Info("Connected & authenticated with Loxone server", "address", ls.address)
 	return nil
 }
 
-func (ls loxoneServer) makeURL(uri string) string {
+func (ls *Server) makeURL(uri string) string {
 	return fmt.Sprintf("http://%s/%s", ls.address, uri)
 }
 
-func (ls *loxoneServer) getApiKey() error {
+func (ls *Server) getApiKey() error {
 	value, err := getLoxoneUrl(ls.makeURL("jdev/cfg/apiKey"))
 	if err != nil {
 		return err
@@ -113,11 +135,13 @@ func (ls *loxoneServer) getApiKey() error {
 		return err
 	}
 	ls.apiKey = apiData.Key
-	log.Printf("Found Loxone Server. Serial %s, Version %s", apiData.SNR, apiData.Version)
+	ls.serial = apiData.SNR
+	ls.version = apiData.Version
+	logging.Subsystem("loxone").Info("Found Loxone server", "serial", apiData.SNR, "version", apiData.Version)
 	return nil
 }
 
-func (ls *loxoneServer) getPublicKey() error {
+func (ls *Server) getPublicKey() error {
 	value, err := getLoxoneUrl(ls.makeURL("jdev/sys/getPublicKey"))
 	if err != nil {
 		return err
@@ -139,19 +163,39 @@ func (ls *loxoneServer) getPublicKey() error {
 	return nil
 }
 
-func (ls *loxoneServer) openWebsocket() error {
-	ws, err := newLxWebsocket(ls.address)
+func (ls *Server) openWebsocket() error {
+	ws, err := newLxWebsocket(ls.address, ls.updates, &ls.stats)
 	if err != nil {
 		return err
 	}
-	ls.ws = &ws
+	ls.wsLock.Lock()
+	ls.ws = ws
+	ls.wsLock.Unlock()
 	return nil
 }
 
-func (ls *loxoneServer) doKeyExchange() error {
+/* The current websocket, or an error while there is none. */
+func (ls *Server) websocket() (*lxWebsocket, error) {
+	ls.wsLock.Lock()
+	defer ls.wsLock.Unlock()
+	if ls.ws == nil {
+		return nil, fmt.Errorf("Not connected to the Miniserver")
+	}
+	return ls.ws, nil
+}
+
+func (ls *Server) sendRecvControl(cmd string) (ControlMessage, error) {
+	ws, err := ls.websocket()
+	if err != nil {
+		return ControlMessage{}, err
+	}
+	return ws.sendRecvControl(cmd)
+}
+
+func (ls *Server) doKeyExchange() error {
 	aesKey, err := ls.getSessionKey()
 
-	ctlData, err := ls.ws.sendRecvControl("jdev/sys/keyexchange/" + ls.encSessionKey)
+	ctlData, err := ls.sendRecvControl("jdev/sys/keyexchange/" + ls.encSessionKey)
 	if err != nil {
 		return err
 	}
@@ -163,21 +207,20 @@ func (ls *loxoneServer) doKeyExchange() error {
 	return nil
 }
 
-func (ls *loxoneServer) getSessionKey() (cipher.Block, error) {
+func (ls *Server) getSessionKey() (cipher.Block, error) {
 	update_rqd := false
 	if len(ls.aesKey) == 0 {
 		ls.aesKey = make([]byte, 32)
 		rand.Read(ls.aesKey)
 		update_rqd = true
-		log.Printf("AES Key: %02x", ls.aesKey)
 	}
 	if len(ls.aesIV) == 0 {
 		ls.aesIV = make([]byte, 16)
 		rand.Read(ls.aesIV)
 		update_rqd = true
-		log.Printf("AES IV : %02x", ls.aesIV)
 	}
 	if update_rqd {
+		logging.Subsystem("loxone").Debug("New session key created")
 		payload := fmt.Sprintf("%02x:%02x", ls.aesKey, ls.aesIV)
 		encryptedBytes, err := rsa.EncryptPKCS1v15(rand.Reader, ls.publicKey, []byte(payload))
 		if err != nil {
@@ -188,8 +231,8 @@ func (ls *loxoneServer) getSessionKey() (cipher.Block, error) {
 	return aes.NewCipher(ls.aesKey)
 }
 
-func (ls *loxoneServer) getKey() (empty hash.Hash, keyed hash.Hash, salt string, err error) {
-	ctlData, err := ls.ws.sendRecvControl("jdev/sys/getkey2/" + ls.userName)
+func (ls *Server) getKey() (empty hash.Hash, keyed hash.Hash, salt string, err error) {
+	ctlData, err := ls.sendRecvControl("jdev/sys/getkey2/" + ls.userName)
 	if err != nil {
 		return
 	}
@@ -209,7 +252,7 @@ func (ls *loxoneServer) getKey() (empty hash.Hash, keyed hash.Hash, salt string,
 	return
 
 }
-func (ls *loxoneServer) getToken() error {
+func (ls *Server) getToken() error {
 	empty, keyed, salt, err := ls.getKey()
 
 	empty.Write([]byte(ls.passWord + ":" + salt))
@@ -226,22 +269,24 @@ func (ls *loxoneServer) getToken() error {
 		return nil
 	}
 	if ctlData.LL.Code != "200" {
-		log.Printf("Failed to get token. Code %s, %s", ctlData.LL.Code, ctlData.LL.Value)
+		logging.Subsystem("loxone").Error("Failed to get token", "code", ctlData.LL.Code,
+			"response", fmt.Sprint(ctlData.LL.Value))
 		return fmt.Errorf("Unable to get a token")
 	}
 	ls.updateToken(ctlData)
 	return nil
 }
 
-func (ls *loxoneServer) updateToken(ctlData loxoneControlMessage) {
+func (ls *Server) updateToken(ctlData ControlMessage) {
 	tokenData := ctlData.LL.Value.(map[string]interface{})
 	ls.token = tokenData["token"].(string)
 	offset := int64(tokenData["validUntil"].(float64))
-	ls.tokenExpiration = loxoneTimeBase.Add(time.Duration(offset) * time.Second)
-	log.Printf("Token Received: '%s', valid until %s", ls.token, ls.tokenExpiration)
+	expiration := loxoneTimeBase.Add(time.Duration(offset) * time.Second)
+	ls.stats.update(func(s *ServerStats) { s.TokenExpiration = expiration })
+	logging.Subsystem("loxone").Info("Token received", "valid_until", expiration)
 }
 
-func (ls *loxoneServer) getTokenHash() (string, error) {
+func (ls *Server) getTokenHash() (string, error) {
 	_, keyed, _, err := ls.getKey()
 	if err != nil {
 		return "", err
@@ -250,7 +295,8 @@ func (ls *loxoneServer) getTokenHash() (string, error) {
 	return fmt.Sprintf("%02x", keyed.Sum(nil)), nil
 }
 
-func (ls *loxoneServer) checkToken() error {
+// CheckToken verifies the current token with the Miniserver.
+func (ls *Server) CheckToken() error {
 	tokenHash, err := ls.getTokenHash()
 	if err != nil {
 		return err
@@ -264,7 +310,9 @@ func (ls *loxoneServer) checkToken() error {
 	return nil
 }
 
-func (ls *loxoneServer) refreshToken() error {
+// RefreshToken requests a new token before the current one expires. This is
+// done automatically once connected.
+func (ls *Server) RefreshToken() error {
 	tokenHash, err := ls.getTokenHash()
 	if err != nil {
 		return err
@@ -283,26 +331,44 @@ func (ls *loxoneServer) refreshToken() error {
 	return nil
 }
 
-func (ls *loxoneServer) serverMonitor() {
-monitorLoop:
+/* Refresh the token before it expires and reconnect if the websocket is
+ * lost. A new monitor is started for the new websocket once reconnected.
+ */
+func (ls *Server) serverMonitor(ws *lxWebsocket) {
 	for {
-		remaining := ls.tokenExpiration.Sub(time.Now())
+		remaining := ls.Stats().TokenExpiration.Sub(time.Now())
 		select {
-		case <-ls.ws.reconnectChannel:
-			log.Print("serverMonitor: reconnect()")
-			if err := ls.connect(); err != nil {
-				log.Printf("Exiting server monitor as unable to connect to server: %s", err)
-				break monitorLoop
+		case <-ws.reconnectChannel:
+			logging.Subsystem("loxone").Warn("Connection lost, reconnecting")
+			ls.stats.update(func(s *ServerStats) { s.Reconnects++ })
+			if err := ls.Connect(); err != nil {
+				logging.Subsystem("loxone").Error("Exiting server monitor as unable to connect to server", "error", err)
 			}
+			return
 		case <-time.After(remaining):
-			log.Printf("serverMonitor: token expired, refreshing...")
-			ls.refreshToken()
+			logging.Subsystem("loxone").Info("Token expiring, refreshing")
+			ls.RefreshToken()
 		}
 	}
 }
 
-func (ls *loxoneServer) getStructureFile() (rv map[string]interface{}, err error) {
-	sData, err := ls.ws.sendRecvBinary("data/LoxApp3.json")
+// Serial returns the serial number of the Miniserver.
+func (ls *Server) Serial() string {
+	return ls.serial
+}
+
+// Version returns the firmware version of the Miniserver.
+func (ls *Server) Version() string {
+	return ls.version
+}
+
+// StructureFile fetches and decodes the structure file, LoxApp3.json.
+func (ls *Server) StructureFile() (rv map[string]interface{}, err error) {
+	ws, err := ls.websocket()
+	if err != nil {
+		return
+	}
+	sData, err := ws.sendRecvBinary("data/LoxApp3.json")
 	if err != nil {
 		return
 	}
@@ -310,53 +376,82 @@ func (ls *loxoneServer) getStructureFile() (rv map[string]interface{}, err error
 	return
 }
 
-func (ls *loxoneServer) enableUpdates() (err error) {
-	_, err = ls.ws.sendRecvControl("jdev/sps/enablebinstatusupdate")
+// EnableUpdates asks the Miniserver to send status updates, which are then
+// received on the Updates channel. Updates are enabled again after a
+// reconnection.
+func (ls *Server) EnableUpdates() (err error) {
+	ws, err := ls.websocket()
+	if err != nil {
+		return
+	}
+	_, err = ws.sendRecvControl("jdev/sps/enablebinstatusupdate")
 	if err != nil {
 		return
 	}
-	ls.updateChannel = ls.ws.stsChannel
+	ls.wsLock.Lock()
 	ls.updatesEnabled = true
-	ls.ws.StartKeepAlive()
+	ls.wsLock.Unlock()
+	ws.StartKeepAlive()
 	return
 }
 
-func (ls loxoneServer) sendCommand(cmd string) error {
-	msg, err := ls.ws.sendRecvControl(cmd)
+// Updates returns the channel status updates are received on. The same
+// channel is used across reconnections.
+func (ls *Server) Updates() <-chan StatusMessage {
+	return ls.updates
+}
+
+// SendCommand sends a command, e.g. jdev/sps/io/<uuid>/On, logging the
+// response.
+func (ls *Server) SendCommand(cmd string) error {
+	msg, err := ls.sendRecvControl(cmd)
+	ls.stats.command(err == nil && msg.LL.Code == "200")
 	if msg.LL.Code != "200" {
-		log.Printf("Error sending command to Loxone: Code %s, %s", msg.LL.Code, msg.LL.Value)
+		logging.Subsystem("loxone").Error("Error sending command to Loxone", "code", msg.LL.Code,
+			"response", fmt.Sprint(msg.LL.Value))
 	} else {
-		log.Print("Message sent to Loxone server OK")
+		logging.Subsystem("loxone").Debug("Command sent to Loxone server OK")
 	}
 	return err
 }
 
-func (ls *loxoneServer) sendEncryptedCommand(cmd string) (ctlData loxoneControlMessage, err error) {
+// SendCommandResult sends a command and returns the response, which is an
+// error unless the response code is 200.
+func (ls *Server) SendCommandResult(cmd string) (msg ControlMessage, err error) {
+	msg, err = ls.sendRecvControl(cmd)
+	ls.stats.command(err == nil && msg.LL.Code == "200")
+	if err != nil {
+		return
+	}
+	if msg.LL.Code != "200" {
+		err = fmt.Errorf("Command returned code %s, %v", msg.LL.Code, msg.LL.Value)
+	}
+	return
+}
+
+func (ls *Server) sendEncryptedCommand(cmd string) (ctlData ControlMessage, err error) {
 	if len(ls.salt) == 0 {
 		ls.salt = make([]byte, 2)
 		rand.Read(ls.salt)
-		log.Print("New salt obtained")
+		logging.Subsystem("loxone").Debug("New salt obtained")
 	}
 	aesKey, err := ls.getSessionKey()
 	if err != nil {
 		return
 	}
 	fullCmd := fmt.Sprintf("salt/%02X/%s\000", ls.salt, cmd)
-	//	log.Printf("sendEncryptedCommand: [%d] '%s'\n", len(fullCmd), fullCmd)
 	fullCmdBytes := []byte(fullCmd)
 	if len(fullCmdBytes)%16 != 0 {
-		//		log.Printf("Padding %d byte command", len(fullCmd))
 		fullCmdBytes = PKCS5Padding([]byte(fullCmd), 16)
 	}
 
 	enc := make([]byte, len(fullCmdBytes))
 	cbc := cipher.NewCBCEncrypter(aesKey, ls.aesIV)
 	cbc.CryptBlocks(enc, fullCmdBytes)
-	//	log.Printf("enc => '%02X'\n", enc)
 	b64 := base64.StdEncoding.EncodeToString(enc)
 	escaped := url.QueryEscape(b64)
 
-	return ls.ws.sendRecvControl("jdev/sys/enc/" + escaped)
+	return ls.sendRecvControl("jdev/sys/enc/" + escaped)
 }
 
 func getLoxoneUrl(url string) (value string, err error) {
@@ -0,0 +1,229 @@
+package loxone
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/zathras777/halox/internal/fakeminiserver"
+)
+
+const (
+	kitchenLight   = "10000001-0000-0001-ffff000000000001"
+	outsideTemp    = "10000005-0000-0001-ffff000000000002"
+	statusText     = "10000007-0000-0001-ffff000000000002"
+	operatingMode  = "1a000001-0000-0001-ffff000000000001"
+	updateDeadline = 5 * time.Second
+)
+
+func connectFakeMiniserver(t *testing.T, fake *fakeminiserver.Server) (*Server, *Structure) {
+	t.Helper()
+	ls, data := fakeminiserver.ConnectClient(t, fake, NewServer)
+	return ls, NewStructure(data, ls.Serial())
+}
+
+func testUUID(t *testing.T, uuidStr string) uuid.UUID {
+	t.Helper()
+	uu, err := ParseUUID(uuidStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return uu
+}
+
+/* Apply status updates until one is received for the state, returning the
+ * last event for it.
+ */
+func waitForState(t *testing.T, ls *Server, s *Structure, uu uuid.UUID) StateEvent {
+	t.Helper()
+	deadline := time.After(updateDeadline)
+	for {
+		select {
+		case msg := <-ls.Updates():
+			var found *StateEvent
+			for _, ev := range s.Update(msg) {
+				if ev.UUID == uu {
+					ev := ev
+					found = &ev
+				}
+			}
+			if found != nil {
+				return *found
+			}
+		case <-deadline:
+			t.Fatalf("No update received for %s", uu)
+		}
+	}
+}
+
+func TestConnectAndStructure(t *testing.T) {
+	fake := fakeminiserver.Start(t)
+	ls, s := connectFakeMiniserver(t, fake)
+
+	if ls.Serial() != fake.Serial || ls.Version() != fake.Version {
+		t.Errorf("Server info %s/%s, expected %s/%s", ls.Serial(), ls.Version(), fake.Serial, fake.Version)
+	}
+	if len(ls.token) == 0 {
+		t.Error("No token received")
+	}
+	if expiration := ls.Stats().TokenExpiration; !expiration.After(time.Now()) {
+		t.Errorf("Token expiration %s is not in the future", expiration)
+	}
+	le, ck := s.Controls[testUUID(t, kitchenLight)]
+	if !ck {
+		t.Fatal("Kitchen light not found in the structure")
+	}
+	if le.Name != "Kitchen Light" || le.Type != "Switch" || le.Room != "Kitchen" || le.Category != "Lighting" {
+		t.Errorf("Unexpected entity %+v", le)
+	}
+	if s.MiniserverName != "Fake Miniserver" {
+		t.Errorf("Miniserver name %s, expected Fake Miniserver", s.MiniserverName)
+	}
+	if s.Global == nil || s.Weather == nil {
+		t.Error("Global states or weather server missing from the structure")
+	}
+}
+
+func TestConnectBadPassword(t *testing.T) {
+	fake := fakeminiserver.Start(t)
+	ls := NewServer(fake.Host, fake.Port, fake.Username, "wrong")
+	if err := ls.Connect(); err == nil {
+		t.Fatal("Connect() succeeded with the wrong password")
+	}
+}
+
+func TestRefreshToken(t *testing.T) {
+	fake := fakeminiserver.Start(t)
+	ls, _ := connectFakeMiniserver(t, fake)
+	if err := ls.RefreshToken(); err != nil {
+		t.Fatalf("RefreshToken() failed: %s", err)
+	}
+	if err := ls.CheckToken(); err != nil {
+		t.Fatalf("CheckToken() failed: %s", err)
+	}
+}
+
+func TestValueUpdates(t *testing.T) {
+	fake := fakeminiserver.Start(t)
+	ls, s := connectFakeMiniserver(t, fake)
+	if err := ls.EnableUpdates(); err != nil {
+		t.Fatalf("EnableUpdates() failed: %s", err)
+	}
+
+	uu := testUUID(t, outsideTemp)
+	if ev := waitForState(t, ls, s, uu); ev.Value != 0.0 || ev.State != "value" {
+		t.Errorf("Initial event %+v, expected value 0", ev)
+	}
+
+	fake.SetValue(outsideTemp, 21.46)
+	ev := waitForState(t, ls, s, uu)
+	if ev.Value != 21.46 || ev.Entity.FloatValue("value") != 21.46 {
+		t.Errorf("Event %+v, expected value 21.46", ev)
+	}
+	if formatted := FormatValue(ev.Entity.StateFormat(ev.State), 21.46); formatted != "21.5°C" {
+		t.Errorf("Formatted value %s, expected 21.5°C", formatted)
+	}
+
+	fake.SetValue(operatingMode, 4)
+	ev = waitForState(t, ls, s, testUUID(t, operatingMode))
+	if ev.Entity != s.Global || ev.State != "operatingMode" {
+		t.Errorf("Event %+v, expected operatingMode of the global states", ev)
+	}
+	if name := s.Global.OperatingModeName(ev.Value.(float64)); name != "Weekend" {
+		t.Errorf("Operating mode %s, expected Weekend", name)
+	}
+}
+
+func TestUnknownOperatingMode(t *testing.T) {
+	var out bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&out, nil)))
+
+	structure := map[string]interface{}{"globalStates": map[string]interface{}{},
+		"operatingModes": map[string]interface{}{"4": "Weekend"}}
+	// Each Miniserver's global states warn about a mode once.
+	for _, serial := range []string{"504F94000001", "504F94000002"} {
+		le, err := newGlobalEntity(structure, serial)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for n := 0; n < 3; n++ {
+			if name := le.OperatingModeName(9); name != "9" {
+				t.Errorf("Unknown operating mode named %s, expected 9", name)
+			}
+		}
+	}
+	if warnings := strings.Count(out.String(), "Unknown operating mode"); warnings != 2 {
+		t.Errorf("%d warnings for an unknown operating mode, expected 2", warnings)
+	}
+}
+
+func TestTextUpdates(t *testing.T) {
+	fake := fakeminiserver.Start(t)
+	ls, s := connectFakeMiniserver(t, fake)
+	fake.SetText(statusText, "abc")
+	fake.SetText("1a000001-0000-0001-ffff000000000004", "")
+	if err := ls.EnableUpdates(); err != nil {
+		t.Fatalf("EnableUpdates() failed: %s", err)
+	}
+
+	uu := testUUID(t, statusText)
+	if ev := waitForState(t, ls, s, uu); ev.Value != "abc" {
+		t.Errorf("Text value '%v', expected 'abc'", ev.Value)
+	}
+	fake.SetText(statusText, "All windows closed")
+	if ev := waitForState(t, ls, s, uu); ev.Value != "All windows closed" {
+		t.Errorf("Text value '%v', expected 'All windows closed'", ev.Value)
+	}
+}
+
+func TestSendCommand(t *testing.T) {
+	fake := fakeminiserver.Start(t)
+	ls, s := connectFakeMiniserver(t, fake)
+
+	le := s.Controls[testUUID(t, kitchenLight)]
+	cmd, err := le.Command([]byte("1.000000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ls.SendCommand(cmd); err != nil {
+		t.Fatalf("SendCommand() failed: %s", err)
+	}
+	received, err := fake.WaitCommand(updateDeadline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "jdev/sps/io/" + kitchenLight + "/On"
+	if received != expected {
+		t.Errorf("Received command %s, expected %s", received, expected)
+	}
+}
+
+func TestLateResponse(t *testing.T) {
+	fake := fakeminiserver.Start(t)
+	ls, _ := connectFakeMiniserver(t, fake)
+	ws, err := ls.websocket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws.replyTimeout = 400 * time.Millisecond
+
+	slow := "jdev/sps/io/" + kitchenLight + "/On"
+	fake.SetResponseDelay(slow, 600*time.Millisecond)
+	if _, err := ls.SendCommandResult(slow); err == nil {
+		t.Fatal("No error for a command whose response was late")
+	}
+	// The late response arrives first and must not be taken for the
+	// response to the next command.
+	fast := "jdev/sps/io/" + kitchenLight + "/Off"
+	msg, err := ls.SendCommandResult(fast)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.LL.Control != fast {
+		t.Errorf("Response for %s, expected %s", msg.LL.Control, fast)
+	}
+}
@@ -0,0 +1,64 @@
+package loxone
+
+import (
+	"sync"
+	"time"
+)
+
+/* Counters for the connection to a Miniserver. Messages is keyed by the
+ * message type of the header received, see StatusMessage. Connected is
+ * true while the websocket is being read.
+ */
+type ServerStats struct {
+	Connected       bool
+	LastMessage     time.Time
+	Connects        uint64
+	Reconnects      uint64
+	Messages        map[byte]uint64
+	CommandsOK      uint64
+	CommandsFailed  uint64
+	TokenExpiration time.Time
+}
+
+type serverStats struct {
+	lock  sync.Mutex
+	stats ServerStats
+}
+
+func (ss *serverStats) update(fn func(*ServerStats)) {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	fn(&ss.stats)
+}
+
+func (ss *serverStats) message(msgType byte) {
+	ss.update(func(s *ServerStats) {
+		if s.Messages == nil {
+			s.Messages = make(map[byte]uint64)
+		}
+		s.Messages[msgType]++
+		s.LastMessage = time.Now()
+	})
+}
+
+func (ss *serverStats) command(ok bool) {
+	ss.update(func(s *ServerStats) {
+		if ok {
+			s.CommandsOK++
+		} else {
+			s.CommandsFailed++
+		}
+	})
+}
+
+/* Return a copy of the current counters. */
+func (ls *Server) Stats() ServerStats {
+	ls.stats.lock.Lock()
+	defer ls.stats.lock.Unlock()
+	rv := ls.stats.stats
+	rv.Messages = make(map[byte]uint64, len(ls.stats.stats.Messages))
+	for msgType, count := range ls.stats.stats.Messages {
+		rv.Messages[msgType] = count
+	}
+	return rv
+}
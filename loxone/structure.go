@@ -0,0 +1,230 @@
+package loxone
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"math"
+
+	"github.com/google/uuid"
+	"github.com/zathras777/halox/logging"
+)
+
+/* The controls described by the structure file, along with the global
+ * states, message center and weather server, linked by state UUID so that
+ * status updates can be applied to them.
+ */
+type Structure struct {
+	// Every entity, keyed by action UUID.
+	Controls map[uuid.UUID]*Entity
+	// Room names keyed by room UUID.
+	Rooms          map[uuid.UUID]string
+	MiniserverName string
+
+	Global        *Entity
+	MessageCenter *Entity
+	Weather       *WeatherServer
+
+	states map[uuid.UUID]*Entity
+	events eventHub
+}
+
+/* A new value for one state of an entity. Value is a float64 for value
+ * states, a string for text states, a Daytimer for daytimer states and a
+ * []WeatherEntry for the weather server. Events returned by Update refer to
+ * the entity in the structure, whose values Update changes, while those
+ * passed to subscribers refer to a snapshot.
+ */
+type StateEvent struct {
+	Entity *Entity
+	State  string
+	UUID   uuid.UUID
+	Value  interface{}
+}
+
+/* Create the entities from a structure file. The serial number of the
+ * Miniserver is used to give the global states a stable UUID.
+ */
+func NewStructure(structure map[string]interface{}, serial string) *Structure {
+	s := &Structure{
+		Controls:       make(map[uuid.UUID]*Entity),
+		Rooms:          make(map[uuid.UUID]string),
+		MiniserverName: "Loxone Miniserver",
+		states:         make(map[uuid.UUID]*Entity),
+	}
+	controls, _ := structure["controls"].(map[string]interface{})
+	for uu, data := range controls {
+		ctl := data.(map[string]interface{})
+		le := newEntity(uu, ctl)
+		le.RoomID, _ = ctl["room"].(string)
+		le.Room = structureName(structure, "rooms", ctl["room"])
+		le.Category = structureName(structure, "cats", ctl["cat"])
+		s.add(&le)
+	}
+
+	if gle, err := newGlobalEntity(structure, serial); err != nil {
+		logging.Subsystem("loxone").Warn(err.Error())
+	} else {
+		s.Global = &gle
+		s.add(&gle)
+	}
+
+	if mce, err := newMessageCenterEntity(structure); err != nil {
+		logging.Subsystem("loxone").Warn(err.Error())
+	} else {
+		s.MessageCenter = &mce
+		s.add(&mce)
+	}
+
+	if ws, err := newWeatherServer(structure); err != nil {
+		logging.Subsystem("loxone").Warn(err.Error())
+	} else {
+		s.Weather = ws
+		wle := ws.entity()
+		s.add(&wle)
+	}
+
+	if rooms, ck := structure["rooms"].(map[string]interface{}); ck {
+		for uuidStr := range rooms {
+			if uu, err := ParseUUID(uuidStr); err == nil {
+				s.Rooms[uu] = structureName(structure, "rooms", uuidStr)
+			}
+		}
+	}
+	if info, ck := structure["msInfo"].(map[string]interface{}); ck {
+		if name, ck := info["msName"].(string); ck && len(name) > 0 {
+			s.MiniserverName = name
+		}
+	}
+	return s
+}
+
+func (s *Structure) add(le *Entity) {
+	for _, uu := range le.States {
+		s.states[uu] = le
+	}
+	s.Controls[le.ActionUUID] = le
+}
+
+/* Find a control by either its UUID or action UUID, as given by Loxone. */
+func (s *Structure) FindControl(uuidStr string) *Entity {
+	uu, err := ParseUUID(uuidStr)
+	if err != nil {
+		return nil
+	}
+	for _, le := range s.Controls {
+		if le.UUID == uu || le.ActionUUID == uu {
+			return le
+		}
+	}
+	return nil
+}
+
+/* Decode a status update, recording the new values against their entities
+ * and returning an event for each. The events are also passed to the
+ * subscribers. States that do not belong to a known entity are ignored.
+ */
+func (s *Structure) Update(msg StatusMessage) []StateEvent {
+	var events []StateEvent
+	switch msg.MsgType {
+	case 2:
+		events = s.parseValueState(msg.Data)
+	case 3:
+		events = s.parseTextState(msg.Data)
+	case 4:
+		events = s.parseDaytimerState(msg.Data)
+	case 7:
+		if s.Weather == nil {
+			return nil
+		}
+		for uu, entries := range parseWeatherState(msg.Data, s.Weather) {
+			if ev, ck := s.update(uu, entries); ck {
+				events = append(events, ev)
+			} else {
+				logging.Subsystem("states").Warn("Weather state for unknown UUID", "uuid", uu)
+			}
+		}
+	default:
+		logging.Subsystem("states").Debug("Ignoring update of unknown type", "type", msg.MsgType)
+		return nil
+	}
+	s.events.publish(events)
+	return events
+}
+
+func (s *Structure) update(uu uuid.UUID, value interface{}) (StateEvent, bool) {
+	le, ck := s.states[uu]
+	if !ck {
+		return StateEvent{}, false
+	}
+	name := le.StateName(uu)
+	le.Values[name] = value
+	return StateEvent{Entity: le, State: name, UUID: uu, Value: value}, true
+}
+
+/* The Loxone server encodes the UUID's as Little Endian, so tranform the bytes
+ * and then create a UUID object.
+ */
+func stateUUID(state []byte) (uu uuid.UUID, err error) {
+	if len(state) < 16 {
+		err = fmt.Errorf("Only %d bytes available for UUID", len(state))
+		return
+	}
+	orderedBytes := []byte{state[3], state[2], state[1], state[0], state[5], state[4], state[7], state[6]}
+	orderedBytes = append(orderedBytes, state[8:16]...)
+	return uuid.FromBytes(orderedBytes)
+}
+
+func (s *Structure) parseValueState(state []byte) (events []StateEvent) {
+	log := logging.Subsystem("states")
+	debug := log.Enabled(context.Background(), slog.LevelDebug)
+	for n := 0; n+24 <= len(state); {
+		uu, err := stateUUID(state[n:])
+		if err != nil {
+			log.Error("Error reading UUID", "position", n, "error", err)
+			break
+		}
+		uval := binary.LittleEndian.Uint64(state[n+16:])
+		float := math.Float64frombits(uval)
+		if debug {
+			log.Debug("Value state", "uuid", uu, "value", float)
+		}
+		n += 24
+		if ev, ck := s.update(uu, float); ck {
+			events = append(events, ev)
+		}
+	}
+	return
+}
+
+func (s *Structure) parseTextState(state []byte) (events []StateEvent) {
+	log := logging.Subsystem("states")
+	debug := log.Enabled(context.Background(), slog.LevelDebug)
+	for n := 0; n+36 <= len(state); {
+		uu, err := stateUUID(state[n:])
+		if err != nil {
+			log.Error("Error reading UUID", "position", n, "error", err)
+			break
+		}
+		// Skip Icon UUID
+		sLen := int(binary.LittleEndian.Uint32(state[n+32:]))
+		n += 36
+		if n+sLen > len(state) {
+			log.Error("Text state is truncated", "uuid", uu)
+			break
+		}
+		val := string(state[n : n+sLen])
+		n += sLen
+		if n%4 != 0 {
+			n += 4 - n%4
+		}
+		if debug {
+			log.Debug("Text state", "uuid", uu, "value", val)
+		}
+		if ev, ck := s.update(uu, val); ck {
+			events = append(events, ev)
+		}
+	}
+	return
+}
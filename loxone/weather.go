@@ -0,0 +1,210 @@
+package loxone
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/zathras777/halox/logging"
+)
+
+const weatherEntrySize = 68
+
+/* The weatherServer section of the structure file gives the UUIDs of the
+ * current and forecast weather data, texts for the weather types and the
+ * format of each field.
+ */
+type WeatherServer struct {
+	Actual   uuid.UUID
+	Forecast uuid.UUID
+	// Zone the Miniserver gives times in, the host's unless set.
+	Location *time.Location
+
+	typeTexts map[int]string
+	formats   map[string]string
+}
+
+/* Current weather or the forecast for one hour. Field names follow the
+ * Home Assistant forecast, so the forecast can be used by a template
+ * weather entity as it is.
+ */
+type WeatherEntry struct {
+	Time                 time.Time         `json:"datetime"`
+	WeatherType          int               `json:"weather_type"`
+	Condition            string            `json:"condition"`
+	Description          string            `json:"description,omitempty"`
+	Temperature          float64           `json:"temperature"`
+	PerceivedTemperature float64           `json:"apparent_temperature"`
+	DewPoint             float64           `json:"dew_point"`
+	Humidity             int               `json:"humidity"`
+	Precipitation        float64           `json:"precipitation"`
+	WindSpeed            float64           `json:"wind_speed"`
+	WindBearing          int               `json:"wind_bearing"`
+	Pressure             float64           `json:"pressure"`
+	SolarRadiation       int               `json:"solar_radiation"`
+	Formatted            map[string]string `json:"formatted,omitempty"`
+}
+
+func newWeatherServer(structure map[string]interface{}) (*WeatherServer, error) {
+	data, ck := structure["weatherServer"].(map[string]interface{})
+	if !ck {
+		return nil, fmt.Errorf("Structure file has no weatherServer")
+	}
+	states, _ := data["states"].(map[string]interface{})
+	actualStr, _ := states["actual"].(string)
+	forecastStr, _ := states["forecast"].(string)
+	actual, err := ParseUUID(actualStr)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid weatherServer actual UUID '%s': %s", actualStr, err)
+	}
+	forecast, err := ParseUUID(forecastStr)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid weatherServer forecast UUID '%s': %s", forecastStr, err)
+	}
+
+	ws := WeatherServer{Actual: actual, Forecast: forecast, Location: time.Local,
+		typeTexts: make(map[int]string), formats: make(map[string]string)}
+	if texts, ck := data["weatherTypeTexts"].(map[string]interface{}); ck {
+		for id, text := range texts {
+			n, err := strconv.Atoi(id)
+			if str, ck := text.(string); ck && err == nil {
+				ws.typeTexts[n] = str
+			}
+		}
+	}
+	if formats, ck := data["format"].(map[string]interface{}); ck {
+		for field, format := range formats {
+			if str, ck := format.(string); ck {
+				ws.formats[field] = str
+			}
+		}
+	}
+	return &ws, nil
+}
+
+/* The weather server is also an entity, with the actual and forecast
+ * states, though it accepts no commands.
+ */
+func (ws *WeatherServer) entity() Entity {
+	return newEntity(UUIDString(ws.Actual), map[string]interface{}{
+		"name":       "Weather",
+		"type":       "WeatherServer",
+		"uuidAction": UUIDString(ws.Actual),
+		"states": map[string]interface{}{
+			"actual":   UUIDString(ws.Actual),
+			"forecast": UUIDString(ws.Forecast),
+		},
+	})
+}
+
+/* Each weather state update consists of
+ *   UUID (16 bytes), last update (uint32), number of entries (int32)
+ * followed by entries of
+ *   timestamp, weather type, wind direction, solar radiation and relative
+ *   humidity (int32), temperature, perceived temperature, dew point,
+ *   precipitation, wind speed and barometric pressure (float64)
+ */
+func parseWeatherState(state []byte, ws *WeatherServer) map[uuid.UUID][]WeatherEntry {
+	rv := make(map[uuid.UUID][]WeatherEntry)
+	for n := 0; n+24 <= len(state); {
+		uu, err := stateUUID(state[n:])
+		if err != nil {
+			logging.Subsystem("states").Error("Error reading UUID", "position", n, "error", err)
+			break
+		}
+		count := int(int32(binary.LittleEndian.Uint32(state[n+20:])))
+		n += 24
+		if count < 0 || n+count*weatherEntrySize > len(state) {
+			logging.Subsystem("states").Error("Invalid weather state", "entries", count)
+			break
+		}
+		entries := make([]WeatherEntry, 0, count)
+		for i := 0; i < count; i++ {
+			entries = append(entries, ws.decodeEntry(state[n:n+weatherEntrySize]))
+			n += weatherEntrySize
+		}
+		rv[uu] = entries
+	}
+	return rv
+}
+
+func (ws *WeatherServer) decodeEntry(data []byte) WeatherEntry {
+	i32 := func(pos int) int {
+		return int(int32(binary.LittleEndian.Uint32(data[pos:])))
+	}
+	f64 := func(pos int) float64 {
+		return math.Float64frombits(binary.LittleEndian.Uint64(data[pos:]))
+	}
+	we := WeatherEntry{
+		Time:                 TimeIn(float64(i32(0)), ws.Location),
+		WeatherType:          i32(4),
+		WindBearing:          i32(8),
+		SolarRadiation:       i32(12),
+		Humidity:             i32(16),
+		Temperature:          f64(20),
+		PerceivedTemperature: f64(28),
+		DewPoint:             f64(36),
+		Precipitation:        f64(44),
+		WindSpeed:            f64(52),
+		Pressure:             f64(60),
+	}
+	we.Condition = weatherConditions[we.WeatherType]
+	if len(we.Condition) == 0 {
+		we.Condition = "exceptional"
+	}
+	we.Description = ws.typeTexts[we.WeatherType]
+	fields := map[string]float64{
+		"temperature":          we.Temperature,
+		"perceivedTemperature": we.PerceivedTemperature,
+		"dewPoint":             we.DewPoint,
+		"relativeHumidity":     float64(we.Humidity),
+		"precipitation":        we.Precipitation,
+		"windSpeed":            we.WindSpeed,
+		"windDirection":        float64(we.WindBearing),
+		"barometricPressure":   we.Pressure,
+		"solarRadiation":       float64(we.SolarRadiation),
+	}
+	for field, value := range fields {
+		if format, ck := ws.formats[field]; ck {
+			if we.Formatted == nil {
+				we.Formatted = make(map[string]string)
+			}
+			we.Formatted[field] = FormatValue(format, value)
+		}
+	}
+	return we
+}
+
+// Home Assistant weather conditions for the Loxone weather types.
+var weatherConditions = map[int]string{
+	1:  "sunny",
+	2:  "partlycloudy",
+	3:  "partlycloudy",
+	4:  "cloudy",
+	5:  "cloudy",
+	6:  "fog",
+	7:  "fog",
+	8:  "rainy",
+	9:  "rainy",
+	10: "pouring",
+	11: "rainy",
+	12: "snowy-rainy",
+	13: "snowy-rainy",
+	14: "rainy",
+	15: "pouring",
+	16: "lightning-rainy",
+	17: "lightning-rainy",
+	18: "snowy",
+	19: "snowy",
+	20: "snowy",
+	21: "snowy",
+	22: "snowy",
+	23: "snowy-rainy",
+	24: "snowy-rainy",
+	25: "snowy-rainy",
+	26: "snowy-rainy",
+	27: "snowy-rainy",
+}
@@ -0,0 +1,80 @@
+package loxone
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/zathras777/halox/internal/fakeminiserver"
+)
+
+const weatherForecast = "1d000001-0000-0001-ffff000000000002"
+
+/* Encode a weather state as the Miniserver sends it, with the UUID in the
+ * same byte order as value states.
+ */
+func weatherFrame(uu uuid.UUID, entries [][]interface{}) []byte {
+	frame := []byte{uu[3], uu[2], uu[1], uu[0], uu[5], uu[4], uu[7], uu[6]}
+	frame = append(frame, uu[8:]...)
+	frame = binary.LittleEndian.AppendUint32(frame, 0)
+	frame = binary.LittleEndian.AppendUint32(frame, uint32(len(entries)))
+	for _, entry := range entries {
+		for _, field := range entry {
+			switch v := field.(type) {
+			case int:
+				frame = binary.LittleEndian.AppendUint32(frame, uint32(int32(v)))
+			case float64:
+				frame = binary.LittleEndian.AppendUint64(frame, math.Float64bits(v))
+			}
+		}
+	}
+	return frame
+}
+
+func TestWeatherState(t *testing.T) {
+	fake := fakeminiserver.Start(t)
+	ls, s := connectFakeMiniserver(t, fake)
+	zone := time.FixedZone("CET", 3600)
+	s.Weather.Location = zone
+	if err := ls.EnableUpdates(); err != nil {
+		t.Fatalf("EnableUpdates() failed: %s", err)
+	}
+
+	// 2024-06-01 14:00 on the Miniserver's clock.
+	ts := int(time.Date(2024, 6, 1, 14, 0, 0, 0, time.UTC).Sub(loxoneTimeBase) / time.Second)
+	uu := testUUID(t, weatherForecast)
+	fake.SendStatus(7, weatherFrame(uu, [][]interface{}{
+		{ts, 9, 270, 150, 85, 12.5, 10.25, 9.5, 1.2, 18.0, 1013.5},
+		{ts + 3600, 1, 180, 600, 40, 21.0, 21.5, 7.0, 0.0, 5.0, 1020.0},
+	}))
+	ev := waitForState(t, ls, s, uu)
+	entries, ck := ev.Value.([]WeatherEntry)
+	if !ck || len(entries) != 2 {
+		t.Fatalf("Weather value %#v, expected 2 entries", ev.Value)
+	}
+
+	we := entries[0]
+	if expected := time.Date(2024, 6, 1, 14, 0, 0, 0, zone); !we.Time.Equal(expected) {
+		t.Errorf("Time %s, expected %s", we.Time, expected)
+	}
+	if we.WeatherType != 9 || we.Condition != "rainy" || we.Description != "Rain" {
+		t.Errorf("Weather type %d, condition %s, description %s, expected 9, rainy, Rain",
+			we.WeatherType, we.Condition, we.Description)
+	}
+	if we.WindBearing != 270 || we.SolarRadiation != 150 || we.Humidity != 85 {
+		t.Errorf("Wind bearing %d, solar radiation %d, humidity %d, expected 270, 150, 85",
+			we.WindBearing, we.SolarRadiation, we.Humidity)
+	}
+	if we.Temperature != 12.5 || we.PerceivedTemperature != 10.25 || we.DewPoint != 9.5 ||
+		we.Precipitation != 1.2 || we.WindSpeed != 18 || we.Pressure != 1013.5 {
+		t.Errorf("Unexpected values %+v", we)
+	}
+	if we.Formatted["temperature"] != "12.5°" || we.Formatted["relativeHumidity"] != "85%" {
+		t.Errorf("Formatted values %v, expected 12.5° and 85%%", we.Formatted)
+	}
+	if entries[1].Condition != "sunny" || !entries[1].Time.Equal(we.Time.Add(time.Hour)) {
+		t.Errorf("Second entry %+v, expected sunny an hour later", entries[1])
+	}
+}
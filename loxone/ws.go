@@ -0,0 +1,245 @@
+package loxone
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/zathras777/halox/logging"
+)
+
+type lxWebsocket struct {
+	address string
+
+	running bool
+
+	ws               *websocket.Conn
+	ctlChannel       chan ControlMessage
+	binChannel       chan []byte
+	stsChannel       chan StatusMessage
+	reconnectChannel chan bool
+	stopKeepAlive    chan bool
+	stats            *serverStats
+
+	sendLock sync.Mutex
+	// Held from sending a command until its response is received, so
+	// responses can't be handed to the wrong caller.
+	cmdLock sync.Mutex
+	// Commands whose response did not arrive in time. The Miniserver
+	// responds in order, so their late responses come first and are
+	// skipped.
+	missed       int
+	replyTimeout time.Duration
+}
+
+// ControlMessage is the JSON response to a command.
+type ControlMessage struct {
+	LL struct {
+		Code    string
+		Control string
+		Value   interface{}
+	}
+}
+
+// StatusMessage is a binary status update of the given type, 2 for value
+// states, 3 for text states, 4 for daytimer states and 7 for weather.
+type StatusMessage struct {
+	MsgType byte
+	Data    []byte
+}
+
+func newLxWebsocket(addr string, sts chan StatusMessage, stats *serverStats) (*lxWebsocket, error) {
+	conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://%s/ws/rfc6455", addr), nil)
+	if err != nil {
+		return nil, err
+	}
+	lws := &lxWebsocket{}
+	lws.ws = conn
+	lws.address = addr
+	lws.ctlChannel = make(chan ControlMessage, 10)
+	lws.replyTimeout = 10 * time.Second
+	lws.binChannel = make(chan []byte, 2)
+	lws.stsChannel = sts
+	lws.stats = stats
+	lws.stopKeepAlive = make(chan bool, 1)
+	lws.reconnectChannel = make(chan bool, 2)
+
+	go lws.autoReceiver()
+
+	return lws, nil
+}
+
+func (lws *lxWebsocket) getControlMessage() (lcm ControlMessage, err error) {
+	select {
+	case lcm = <-lws.ctlChannel:
+		break
+	case <-time.After(lws.replyTimeout):
+		err = fmt.Errorf("No message for %s", lws.replyTimeout)
+	}
+	return
+}
+
+func (lws *lxWebsocket) getBinaryMessage() (data []byte, err error) {
+	select {
+	case data = <-lws.binChannel:
+		break
+	case <-time.After(lws.replyTimeout):
+		err = fmt.Errorf("No message for %s", lws.replyTimeout)
+	}
+	return
+}
+
+func (lws *lxWebsocket) sendTextMessage(cmd []byte) (err error) {
+	lws.sendLock.Lock()
+	err = lws.ws.WriteMessage(websocket.TextMessage, []byte(cmd))
+	lws.sendLock.Unlock()
+	if err != nil {
+		logging.Subsystem("websocket").Error("Error sending to websocket", "error", err)
+	}
+	return
+}
+
+func (lws *lxWebsocket) sendRecvControl(cmd string) (msg ControlMessage, err error) {
+	lws.cmdLock.Lock()
+	defer lws.cmdLock.Unlock()
+	logging.Subsystem("websocket").Debug("TX", "command", cmd)
+	err = lws.sendTextMessage(([]byte(cmd)))
+	if err != nil {
+		return
+	}
+	for {
+		if msg, err = lws.getControlMessage(); err != nil {
+			lws.missed++
+			return
+		}
+		if lws.missed == 0 {
+			return
+		}
+		lws.missed--
+		logging.Subsystem("websocket").Warn("Skipping a late response", "control", msg.LL.Control)
+	}
+}
+
+func (lws *lxWebsocket) sendRecvBinary(cmd string) (data []byte, err error) {
+	lws.cmdLock.Lock()
+	defer lws.cmdLock.Unlock()
+	logging.Subsystem("websocket").Debug("TX", "command", cmd)
+	err = lws.sendTextMessage(([]byte(cmd)))
+	if err != nil {
+		return
+	}
+	return lws.getBinaryMessage()
+}
+
+func (lws *lxWebsocket) recvMessage() (err error) {
+	// Read header
+	_, msg, err := lws.ws.ReadMessage()
+	if err != nil {
+		logging.Subsystem("websocket").Error("Unable to read from websocket", "error", err)
+		return
+	}
+	if msg[0] != 0x03 {
+		err = fmt.Errorf("Invalid header received, 0x%02X vs 0x03 expected", msg[0])
+		return
+	}
+	// If it's an estimated header, get the accurate size
+	if msg[2] == 0x80 {
+		return lws.recvMessage()
+	}
+
+	msgType := msg[1]
+	msgLen := binary.LittleEndian.Uint32(msg[4:])
+	lws.stats.message(msgType)
+	switch msgType {
+	case 5:
+		logging.Subsystem("websocket").Warn("Miniserver is out of service, waiting 1 minute then trying to reconnect")
+		time.Sleep(time.Minute)
+		return
+	case 6:
+		// keepalive response...
+		return
+	}
+
+	logging.Subsystem("websocket").Debug("RX", "type", msgType, "length", msgLen)
+
+	_, msg, err = lws.ws.ReadMessage()
+	if err != nil {
+		err = fmt.Errorf("Unable to read from websocket: %s", err)
+		return
+	}
+	if len(msg) == 0 {
+		err = fmt.Errorf("Zero byte packet received?")
+		return
+	}
+	if len(msg) == 8 && msg[0] == 0x03 {
+		err = fmt.Errorf("Header received when message was expected??? %s", string(msg))
+		return
+	}
+
+	switch msgType {
+	case 0:
+		var respData ControlMessage
+		logging.Subsystem("websocket").Debug("RX control message", "message", string(msg))
+		if err = json.Unmarshal(msg, &respData); err != nil {
+			return
+		}
+		lws.ctlChannel <- respData
+		return
+	case 1:
+		lws.binChannel <- msg
+		return
+	case 2, 3, 4, 7:
+		lws.stsChannel <- StatusMessage{msgType, msg}
+		//	ValueState = 2
+		//  TextState = 3
+		//  DaytimerState = 4
+		//  OOS = 5
+		//  Keepalive = 6
+		//  WeatherState = 7
+	}
+	return
+}
+
+func (lws *lxWebsocket) autoReceiver() {
+	logging.Subsystem("websocket").Debug("Starting autoReceiver")
+	lws.running = true
+	lws.stats.update(func(s *ServerStats) { s.Connected = true })
+	for {
+		err := lws.recvMessage()
+		if err != nil {
+			logging.Subsystem("websocket").Error("Error receiving a message", "error", err)
+			break
+		}
+	}
+	logging.Subsystem("websocket").Info("autoReceiver stopped")
+	lws.running = false
+	lws.stats.update(func(s *ServerStats) { s.Connected = false })
+	lws.reconnectChannel <- true
+	lws.stopKeepAlive <- true
+}
+
+func (lws *lxWebsocket) StartKeepAlive() {
+	logging.Subsystem("websocket").Debug("Starting keepalive sending")
+	go func() {
+		msg := []byte("keepalive")
+	keepAliveLoop:
+		for {
+			err := lws.sendTextMessage(msg)
+			if err != nil {
+				logging.Subsystem("websocket").Error("Error sending keepalive to server", "error", err)
+				break
+			}
+			select {
+			case <-time.After(5 * time.Second):
+				continue
+			case <-lws.stopKeepAlive:
+				logging.Subsystem("websocket").Debug("Exiting keepalive as reconnect signalled")
+				break keepAliveLoop
+			}
+		}
+		logging.Subsystem("websocket").Debug("Stopped keepalive sending")
+	}()
+}
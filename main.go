@@ -3,120 +3,188 @@ package main
 import (
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 
-	"github.com/google/uuid"
+	"github.com/zathras777/halox/health"
+	"github.com/zathras777/halox/logging"
+	"github.com/zathras777/halox/metrics"
+	"github.com/zathras777/halox/mqttbridge"
 )
 
-var stateLinks map[uuid.UUID]*loxoneEntity
-var actionLinks map[uuid.UUID]*loxoneEntity
+/* A subcommand, run with the configuration and the arguments following
+ * its name.
+ */
+type command struct {
+	name  string
+	usage string
+	help  string
+	run   func(cfg yamlConfig, args []string) error
+}
+
+var commands = []command{
+	{"run", "", "Bridge the Miniserver to MQTT (the default)", runBridge},
+	{"list", "", "List the controls with their type, room and UUIDs", listControls},
+	{"states", "<control>", "Show the current value of each state of a control", showStates},
+	{"send", "<control> <command>", "Send a command to a control, e.g. on or pulse", sendCommand},
+	{"watch", "[control...]", "Print status updates as they are received", watchUpdates},
+	{"structure", "", "Print the structure file, LoxApp3.json", dumpStructure},
+	{"discovery", "[-publish] [-yaml]", "Print or publish the Home Assistant discovery configs", showDiscovery},
+	{"config", "check", "Check the configuration and print it as it will be used", checkConfig},
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [options] [command] [arguments]\n\nCommands:\n", os.Args[0])
+	for _, cmd := range commands {
+		fmt.Fprintf(out, "  %-10s %-22s %s\n", cmd.name, cmd.usage, cmd.help)
+	}
+	fmt.Fprint(out, "\nControls are given by name or UUID.\n\nOptions:\n")
+	flag.PrintDefaults()
+}
 
 func main() {
-	var cfgFile string
+	var cfgFile, miniserver string
 	var hass bool
 
 	flag.StringVar(&cfgFile, "cfg", "configuration.yaml", "Configuration file to use")
-	flag.BoolVar(&hass, "hass", false, "Display HASS configuration yaml")
+	flag.StringVar(&miniserver, "miniserver", "", "Name of the Miniserver other commands use, by default the first")
+	flag.BoolVar(&hass, "hass", false, "Display HASS configuration yaml, as discovery -yaml")
+	flag.Usage = usage
 	flag.Parse()
 
-	cfg, err := parseConfigFile(cfgFile)
-	if err != nil {
-		panic(err)
+	name, args := "run", flag.Args()
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
 	}
-
-	if len(cfg.Logging.File) > 0 {
-		file, err := os.OpenFile(cfg.Logging.File, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
-		if err != nil {
-			panic(fmt.Errorf("Unable to open log file %s to use: %s", cfg.Logging.File, err))
-		}
-		log.SetOutput(file)
-		defer file.Close()
+	if hass {
+		name, args = "discovery", []string{"-yaml"}
 	}
-	/*
-		if cfg.Logging.Syslog {
-			syslogger, err := syslog.New(syslog.LOG_INFO, "halox")
-			if err != nil {
-				log.Fatalln(err)
-			}
-
-			log.SetOutput(syslogger)
+	var cmd *command
+	for n := range commands {
+		if commands[n].name == name {
+			cmd = &commands[n]
 		}
-	*/
-
-	log.Print("halox starting")
-
-	stateLinks = make(map[uuid.UUID]*loxoneEntity)
-	actionLinks = make(map[uuid.UUID]*loxoneEntity)
-
-	ls := newLoxoneServer(cfg.Loxone.Host, cfg.Loxone.Port, cfg.Loxone.Username, cfg.Loxone.Password)
+	}
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "Unknown command '%s'\n\n", name)
+		usage()
+		os.Exit(2)
+	}
 
-	err = ls.connect()
+	cfg, err := parseConfigFile(cfgFile)
 	if err != nil {
-		log.Print(err)
-		fmt.Printf("%s\n", err)
-		return
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	cfg.selected = miniserver
+	// Keep the output of the other commands readable.
+	if cmd.name != "run" && len(cfg.Logging.Level) == 0 {
+		cfg.Logging.Level = "warn"
+	}
+	closeLog, err := logging.Setup(cfg.Logging)
+	if err != nil {
+		// Still the default logger, writing to stderr.
+		slog.Error("Unable to set up logging", "error", err)
+		os.Exit(1)
 	}
 
-	structure, err := ls.getStructureFile()
+	err = cmd.run(cfg, args)
+	closeLog()
 	if err != nil {
-		log.Println(err)
-		return
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
+}
 
-	for uu, data := range structure["controls"].(map[string]interface{}) {
-		le := newLoxoneEntity(uu, data.(map[string]interface{}))
+/* Bridge every configured Miniserver, each with its own connections to the
+ * Miniserver and MQTT server, until a signal is received or one of them
+ * fails.
+ */
+func runBridge(cfg yamlConfig, args []string) error {
+	logger := logging.Subsystem("halox")
+	logger.Info("halox starting")
 
-		for _, uuid := range le.states {
-			stateLinks[uuid] = &le
+	servers, err := cfg.miniservers()
+	if err != nil {
+		return err
+	}
+	var bridges []*mqttbridge.Bridge
+	var collectors []*metrics.Metrics
+	var checker *health.Checker
+	group := health.NewGroup()
+	for _, ms := range servers {
+		ls, structure, err := connectMiniserver(ms)
+		if err != nil {
+			return err
+		}
+		bridge, err := mqttbridge.New(ls, structure, cfg.bridgeConfig(ms))
+		if err != nil {
+			return err
+		}
+		bridges = append(bridges, bridge)
+		if len(cfg.HTTP.Listen) > 0 {
+			collectors = append(collectors, metrics.NewNamed(ms.Name, ls, structure, bridge))
+			checker = health.New(ls, bridge)
+			group.Add(ms.Name, checker)
 		}
-		actionLinks[le.uuidAction] = &le
 	}
 
-	if hass {
-		fmt.Println("Need to display HASS YAML...")
-		fmt.Println("switch:")
-		for _, le := range actionLinks {
-			fmt.Println(le.hassYaml())
+	if len(cfg.HTTP.Listen) > 0 {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.CombinedHandler(collectors))
+		if len(cfg.Miniservers) > 0 {
+			mux.Handle("/healthz", group.Healthz())
+			mux.Handle("/readyz", group.Readyz())
+		} else {
+			mux.Handle("/healthz", checker.Healthz())
+			mux.Handle("/readyz", checker.Readyz())
 		}
-		os.Exit(0)
+		go serveHTTP(cfg.HTTP.Listen, mux)
 	}
 
-	mqChan, actionChannel, err := startMQTT(cfg.MQTT.Host, cfg.MQTT.Port)
-	if err != nil {
-		log.Print(err)
-		return
+	for _, bridge := range bridges {
+		if err := bridge.Connect(); err != nil {
+			return err
+		}
 	}
-
-	if err := ls.enableUpdates(); err != nil {
-		fmt.Println(err)
-		return
+	closeAll := func() {
+		for _, bridge := range bridges {
+			bridge.Close()
+		}
 	}
 
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-
-mainLoop:
-	for {
-		select {
-		case msg := <-ls.updateChannel:
-			switch msg.MsgType {
-			case 2:
-				parseValueState(msg.Data, mqChan)
-			case 3:
-				parseTextState(msg.Data, mqChan)
-			default:
-				log.Printf("Received update packet of type %d, ignoring...", msg.MsgType)
-			}
-		case cmd := <-actionChannel:
-			ls.sendCommand(cmd)
-		case <-sigs:
-			log.Print("Signal received, exiting...")
-			break mainLoop
+	go func() {
+		<-sigs
+		logger.Info("Signal received, exiting")
+		closeAll()
+	}()
+
+	errs := make(chan error, len(bridges))
+	for _, bridge := range bridges {
+		go func(b *mqttbridge.Bridge) {
+			errs <- b.Run()
+		}(bridge)
+	}
+	var rv error
+	for range bridges {
+		if err := <-errs; err != nil && rv == nil {
+			rv = err
+			closeAll()
 		}
 	}
+	return rv
+}
 
-	return
+func serveHTTP(addr string, handler http.Handler) {
+	logger := logging.Subsystem("http")
+	logger.Info("HTTP listener started", "address", addr)
+	if err := http.ListenAndServe(addr, handler); err != nil {
+		logger.Error("HTTP listener stopped", "error", err)
+	}
 }
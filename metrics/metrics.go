@@ -0,0 +1,201 @@
+// Package metrics exposes counters for the Miniserver connection and the
+// MQTT bridge, along with the value of every numeric Loxone state, as
+// Prometheus metrics.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/zathras777/halox/loxone"
+	"github.com/zathras777/halox/mqttbridge"
+)
+
+const stateBuffer = 1000
+
+var messageTypes = map[byte]string{
+	0: "text",
+	1: "file",
+	2: "value_states",
+	3: "text_states",
+	4: "daytimer_states",
+	5: "out_of_service",
+	6: "keepalive",
+	7: "weather_states",
+}
+
+type descs struct {
+	connects      *prometheus.Desc
+	reconnects    *prometheus.Desc
+	messages      *prometheus.Desc
+	commands      *prometheus.Desc
+	tokenExpiry   *prometheus.Desc
+	eventsDropped *prometheus.Desc
+	publish       *prometheus.Desc
+}
+
+func newDescs(labels prometheus.Labels) descs {
+	return descs{
+		connects: prometheus.NewDesc("halox_loxone_connects_total",
+			"Successful connections to the Miniserver.", nil, labels),
+		reconnects: prometheus.NewDesc("halox_loxone_reconnects_total",
+			"Reconnections after the websocket to the Miniserver was lost.", nil, labels),
+		messages: prometheus.NewDesc("halox_loxone_messages_total",
+			"Messages received from the Miniserver by type.", []string{"type"}, labels),
+		commands: prometheus.NewDesc("halox_loxone_commands_total",
+			"Commands sent to the Miniserver by result.", []string{"result"}, labels),
+		tokenExpiry: prometheus.NewDesc("halox_loxone_token_expiry_timestamp_seconds",
+			"When the current token expires.", nil, labels),
+		eventsDropped: prometheus.NewDesc("halox_loxone_events_dropped_total",
+			"State events dropped because a subscriber was too slow.", nil, labels),
+		publish: prometheus.NewDesc("halox_mqtt_messages_total",
+			"Values passed through the MQTT publish queue by outcome.", []string{"outcome"}, labels),
+	}
+}
+
+/* Collects the metrics for a Miniserver and, optionally, the bridge
+ * publishing it to MQTT.
+ */
+type Metrics struct {
+	server    *loxone.Server
+	structure *loxone.Structure
+	bridge    *mqttbridge.Bridge
+	descs     descs
+
+	registry *prometheus.Registry
+	latency  prometheus.Histogram
+	states   *prometheus.GaugeVec
+	events   <-chan loxone.StateEvent
+}
+
+/* Create the metrics and start following the states of the structure. The
+ * bridge may be nil; if given, its OnPublish is set, so New must be called
+ * before the bridge is connected.
+ */
+func New(server *loxone.Server, structure *loxone.Structure, bridge *mqttbridge.Bridge) *Metrics {
+	return NewNamed("", server, structure, bridge)
+}
+
+/* As New, but with every metric labelled miniserver="<name>", so that the
+ * metrics of several Miniservers can be served together by
+ * CombinedHandler.
+ */
+func NewNamed(name string, server *loxone.Server, structure *loxone.Structure, bridge *mqttbridge.Bridge) *Metrics {
+	var labels prometheus.Labels
+	if len(name) > 0 {
+		labels = prometheus.Labels{"miniserver": name}
+	}
+	m := &Metrics{
+		server:    server,
+		structure: structure,
+		bridge:    bridge,
+		descs:     newDescs(labels),
+		registry:  prometheus.NewRegistry(),
+		latency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:        "halox_mqtt_publish_latency_seconds",
+			Help:        "Time taken for MQTT publishes to be acknowledged.",
+			Buckets:     prometheus.ExponentialBuckets(0.001, 4, 8),
+			ConstLabels: labels,
+		}),
+		states: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name:        "halox_loxone_state",
+			Help:        "Current value of a numeric Loxone state.",
+			ConstLabels: labels,
+		}, []string{"uuid", "control", "type", "room", "state"}),
+	}
+	m.registry.MustRegister(m, m.states)
+	if bridge != nil {
+		m.registry.MustRegister(m.latency)
+		bridge.OnPublish = m.observePublish
+	}
+	m.events = structure.SubscribeBuffered(loxone.EventFilter{}, stateBuffer, loxone.DropOldest)
+	go m.followStates()
+	return m
+}
+
+/* The HTTP handler serving the metrics. */
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+/* An HTTP handler serving the metrics of several Miniservers, created with
+ * NewNamed.
+ */
+func CombinedHandler(ms []*Metrics) http.Handler {
+	var gatherers prometheus.Gatherers
+	for _, m := range ms {
+		gatherers = append(gatherers, m.registry)
+	}
+	return promhttp.HandlerFor(gatherers, promhttp.HandlerOpts{})
+}
+
+/* Stop following the states of the structure. */
+func (m *Metrics) Close() {
+	m.structure.Unsubscribe(m.events)
+}
+
+func (m *Metrics) followStates() {
+	for ev := range m.events {
+		val, ck := ev.Value.(float64)
+		if !ck {
+			continue
+		}
+		le := ev.Entity
+		m.states.WithLabelValues(loxone.UUIDString(ev.UUID), le.Name, le.Type, le.Room, ev.State).Set(val)
+	}
+}
+
+func (m *Metrics) observePublish(latency time.Duration, err error) {
+	if err == nil {
+		m.latency.Observe(latency.Seconds())
+	}
+}
+
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	ch <- m.descs.connects
+	ch <- m.descs.reconnects
+	ch <- m.descs.messages
+	ch <- m.descs.commands
+	ch <- m.descs.tokenExpiry
+	ch <- m.descs.eventsDropped
+	if m.bridge != nil {
+		ch <- m.descs.publish
+	}
+}
+
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	stats := m.server.Stats()
+	ch <- prometheus.MustNewConstMetric(m.descs.connects, prometheus.CounterValue, float64(stats.Connects))
+	ch <- prometheus.MustNewConstMetric(m.descs.reconnects, prometheus.CounterValue, float64(stats.Reconnects))
+	for msgType, count := range stats.Messages {
+		name, ck := messageTypes[msgType]
+		if !ck {
+			name = strconv.Itoa(int(msgType))
+		}
+		ch <- prometheus.MustNewConstMetric(m.descs.messages, prometheus.CounterValue, float64(count), name)
+	}
+	ch <- prometheus.MustNewConstMetric(m.descs.commands, prometheus.CounterValue, float64(stats.CommandsOK), "ok")
+	ch <- prometheus.MustNewConstMetric(m.descs.commands, prometheus.CounterValue, float64(stats.CommandsFailed), "error")
+	if !stats.TokenExpiration.IsZero() {
+		ch <- prometheus.MustNewConstMetric(m.descs.tokenExpiry, prometheus.GaugeValue,
+			float64(stats.TokenExpiration.Unix()))
+	}
+	ch <- prometheus.MustNewConstMetric(m.descs.eventsDropped, prometheus.CounterValue, float64(m.structure.Dropped()))
+
+	if m.bridge == nil {
+		return
+	}
+	ps := m.bridge.PublishStats()
+	for outcome, count := range map[string]uint64{
+		"queued":    ps.Queued,
+		"coalesced": ps.Coalesced,
+		"dropped":   ps.Dropped,
+		"published": ps.Published,
+		"failed":    ps.Failed,
+	} {
+		ch <- prometheus.MustNewConstMetric(m.descs.publish, prometheus.CounterValue, float64(count), outcome)
+	}
+}
@@ -0,0 +1,124 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zathras777/halox/internal/fakeminiserver"
+	"github.com/zathras777/halox/loxone"
+)
+
+const (
+	outsideTemp = "10000005-0000-0001-ffff000000000002"
+	kitchenOn   = "jdev/sps/io/10000001-0000-0001-ffff000000000001/On"
+)
+
+func scrape(t *testing.T, h http.Handler) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, err := io.ReadAll(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+/* Scrape until every expected line is present. */
+func waitForMetrics(t *testing.T, h http.Handler, expected ...string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		body := scrape(t, h)
+		missing := ""
+		for _, line := range expected {
+			if !strings.Contains(body, line) {
+				missing = line
+				break
+			}
+		}
+		if len(missing) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Metric %s not found in\n%s", missing, body)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+/* Connect to a fake Miniserver, passing status updates to the structure
+ * until the test ends.
+ */
+func connect(t *testing.T) (*fakeminiserver.Server, *loxone.Server, *loxone.Structure) {
+	t.Helper()
+	fake := fakeminiserver.Start(t)
+	ls, data := fakeminiserver.ConnectClient(t, fake, loxone.NewServer)
+	structure := loxone.NewStructure(data, ls.Serial())
+
+	stop := make(chan struct{})
+	t.Cleanup(func() { close(stop) })
+	go func() {
+		for {
+			select {
+			case msg := <-ls.Updates():
+				structure.Update(msg)
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return fake, ls, structure
+}
+
+func TestMetrics(t *testing.T) {
+	fake, ls, structure := connect(t)
+	m := New(ls, structure, nil)
+	t.Cleanup(m.Close)
+	if err := ls.EnableUpdates(); err != nil {
+		t.Fatal(err)
+	}
+	fake.SetValue(outsideTemp, 21.5)
+	if err := ls.SendCommand(kitchenOn); err != nil {
+		t.Fatal(err)
+	}
+
+	waitForMetrics(t, m.Handler(),
+		"halox_loxone_connects_total 1\n",
+		`halox_loxone_commands_total{result="ok"} 1`+"\n",
+		`halox_loxone_messages_total{type="value_states"}`,
+		"halox_loxone_token_expiry_timestamp_seconds ",
+		`halox_loxone_state{control="Outside Temperature",room="Outside",state="value",type="InfoOnlyAnalog",uuid="`+outsideTemp+`"} 21.5`+"\n",
+	)
+	if body := scrape(t, m.Handler()); strings.Contains(body, "halox_mqtt_") {
+		t.Error("MQTT metrics present without a bridge")
+	}
+}
+
+func TestCombinedHandler(t *testing.T) {
+	var ms []*Metrics
+	fakes := make(map[string]*fakeminiserver.Server)
+	for _, name := range []string{"house", "garage"} {
+		fake, ls, structure := connect(t)
+		m := NewNamed(name, ls, structure, nil)
+		t.Cleanup(m.Close)
+		if err := ls.EnableUpdates(); err != nil {
+			t.Fatal(err)
+		}
+		fakes[name] = fake
+		ms = append(ms, m)
+	}
+	fakes["house"].SetValue(outsideTemp, 21.5)
+	fakes["garage"].SetValue(outsideTemp, 12.5)
+
+	waitForMetrics(t, CombinedHandler(ms),
+		`halox_loxone_connects_total{miniserver="house"} 1`+"\n",
+		`halox_loxone_connects_total{miniserver="garage"} 1`+"\n",
+		`halox_loxone_state{control="Outside Temperature",miniserver="house",room="Outside",state="value",type="InfoOnlyAnalog",uuid="`+outsideTemp+`"} 21.5`+"\n",
+		`halox_loxone_state{control="Outside Temperature",miniserver="garage",room="Outside",state="value",type="InfoOnlyAnalog",uuid="`+outsideTemp+`"} 12.5`+"\n",
+	)
+}
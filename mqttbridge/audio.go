@@ -0,0 +1,97 @@
+package mqttbridge
+
+import (
+	"encoding/json"
+
+	"github.com/zathras777/halox/logging"
+)
+
+/* The combined state of a music server zone, published as JSON on
+ * loxone/<action uuid>/media. Loxone states that have not been received
+ * are left empty.
+ */
+type audioZoneState struct {
+	ServerState string        `json:"server_state"`
+	PlayState   string        `json:"play_state"`
+	Power       bool          `json:"power"`
+	Volume      float64       `json:"volume"`
+	Source      int           `json:"source"`
+	Sources     []audioSource `json:"sources"`
+	Title       string        `json:"title,omitempty"`
+	Artist      string        `json:"artist,omitempty"`
+	Album       string        `json:"album,omitempty"`
+	Station     string        `json:"station,omitempty"`
+	Cover       string        `json:"cover,omitempty"`
+	Duration    float64       `json:"duration"`
+	Progress    float64       `json:"progress"`
+}
+
+type audioSource struct {
+	Slot int    `json:"slot"`
+	Name string `json:"name"`
+}
+
+var audioServerStates = map[int]string{
+	-3: "unknown",
+	-2: "unreachable",
+	-1: "unknown",
+	0:  "offline",
+	1:  "initializing",
+	2:  "online",
+}
+
+var audioPlayStates = map[int]string{
+	-1: "unknown",
+	0:  "stopped",
+	1:  "paused",
+	2:  "playing",
+}
+
+func (le entity) audioZoneState() audioZoneState {
+	az := audioZoneState{
+		ServerState: audioServerStates[int(le.FloatValue("serverState"))],
+		PlayState:   audioPlayStates[int(le.FloatValue("playState"))],
+		Power:       le.FloatValue("power") != 0,
+		Volume:      le.FloatValue("volume"),
+		Source:      int(le.FloatValue("source")),
+		Sources:     parseAudioSources(le.TextValue("sourceList")),
+		Title:       le.TextValue("songName"),
+		Artist:      le.TextValue("artist"),
+		Album:       le.TextValue("album"),
+		Station:     le.TextValue("station"),
+		Cover:       le.TextValue("cover"),
+		Duration:    le.FloatValue("duration"),
+		Progress:    le.FloatValue("progress"),
+	}
+	if _, ck := le.Values["playState"]; !ck {
+		az.PlayState = "unknown"
+	}
+	if _, ck := le.Values["serverState"]; !ck {
+		az.ServerState = "unknown"
+	}
+	return az
+}
+
+/* The sourceList state is a text state containing the zone favourites as
+ * returned by the music server, i.e.
+ *   {"getroomfavs_result": [{"id": 1, "items": [{"slot": 1, "name": "Radio"}]}]}
+ */
+func parseAudioSources(sourceList string) []audioSource {
+	rv := []audioSource{}
+	if len(sourceList) == 0 {
+		return rv
+	}
+	var favs struct {
+		Result []struct {
+			Items []audioSource
+		} `json:"getroomfavs_result"`
+	}
+	if err := json.Unmarshal([]byte(sourceList), &favs); err != nil {
+		logging.Subsystem("mqtt").Warn("Unable to parse audio zone source list", "error", err)
+		return rv
+	}
+	for _, res := range favs.Result {
+		rv = append(rv, res.Items...)
+	}
+	return rv
+}
@@ -0,0 +1,491 @@
+// Package mqttbridge publishes the states of Loxone controls to MQTT,
+// along with Home Assistant discovery configs, and passes commands
+// received over MQTT back to the Miniserver.
+package mqttbridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/google/uuid"
+	"github.com/zathras777/halox/logging"
+	"github.com/zathras777/halox/loxone"
+)
+
+const (
+	defaultTopic = "loxone"
+
+	// Below the configured topic.
+	notificationTopic    = "events/notification"
+	messageTopic         = "events/message"
+	weatherCurrentTopic  = "weather/current"
+	weatherForecastTopic = "weather/forecast"
+)
+
+/* Configuration of the bridge. MQTT is the mqtt section of the
+ * configuration file, the others are top level sections.
+ */
+type Config struct {
+	MQTT      MQTTConfig
+	Controls  ControlFilter
+	Filters   []PublishFilter
+	Overrides map[string]ControlOverride
+	// Prefix Home Assistant unique IDs and device identifiers with the
+	// Miniserver serial number, for when several Miniservers are bridged.
+	QualifyIDs bool `yaml:"-"`
+}
+
+/* The MQTT server and how states are published. Topic is the topic every
+ * other topic is below, "loxone" if not set.
+ */
+type MQTTConfig struct {
+	Host            string
+	Port            int
+	Topic           string
+	QoS             int `yaml:"qos"`
+	QueueSize       int `yaml:"queue_size"`
+	Discovery       bool
+	DiscoveryPrefix string `yaml:"discovery_prefix"`
+	Devices         string
+	JSONState       bool          `yaml:"json_state"`
+	JSONDebounce    time.Duration `yaml:"json_debounce"`
+}
+
+/* Bridge links a Miniserver to an MQTT server. Create it with New, then
+ * call Connect and Run.
+ */
+type Bridge struct {
+	// Called from Run for every state update received, whether or not the
+	// control is exposed.
+	OnState func(loxone.StateEvent)
+	// Called once each publish has been acknowledged, or has failed, with
+	// the time taken. Set before calling Connect.
+	OnPublish func(time.Duration, error)
+
+	cfg             Config
+	server          *loxone.Server
+	structure       *loxone.Structure
+	miniserver      miniserverInfo
+	discoveryPrefix string
+
+	// Exposed entities by action and state UUID, and those excluded by the
+	// configuration, kept so their discovery configs can be removed.
+	entities map[uuid.UUID]*entity
+	states   map[uuid.UUID]*entity
+	hidden   map[uuid.UUID]*entity
+
+	client     mqtt.Client
+	queue      *publishQueue
+	actions    chan string
+	jsonStates *jsonStatePublisher
+	held       *heldStates
+
+	// Message center fetches requested by Run and their results, as the
+	// response can take a while and updates must keep being read.
+	fetches chan *entity
+	fetched chan messageFetch
+
+	lock      sync.Mutex
+	running   bool
+	closeOnce sync.Once
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+/* An entity as exposed over MQTT, with the per control state the bridge
+ * needs on top of the Loxone entity.
+ */
+type entity struct {
+	*loxone.Entity
+	miniserver *miniserverInfo
+	override   *ControlOverride
+
+	// Last value published for each derived topic.
+	derived map[string]string
+
+	// Value and time each state was last published, used by the filters.
+	published map[string]lastPublish
+
+	// Message center entries that have already been published.
+	seen map[string]bool
+}
+
+/* Create a bridge for the controls in the structure, applying the control
+ * filter and overrides from the configuration.
+ */
+func New(server *loxone.Server, structure *loxone.Structure, cfg Config) (*Bridge, error) {
+	if cfg.MQTT.QoS < 0 || cfg.MQTT.QoS > 2 {
+		return nil, fmt.Errorf("Invalid MQTT QoS %d, must be 0, 1 or 2", cfg.MQTT.QoS)
+	}
+	for _, cs := range append(cfg.Controls.Include, cfg.Controls.Exclude...) {
+		if err := cs.Validate(); err != nil {
+			return nil, fmt.Errorf("Invalid control selector: %s", err)
+		}
+	}
+	for _, pf := range cfg.Filters {
+		if err := pf.Validate(); err != nil {
+			return nil, fmt.Errorf("Invalid publish filter: %s", err)
+		}
+	}
+	b := &Bridge{
+		cfg:       cfg,
+		server:    server,
+		structure: structure,
+		miniserver: miniserverInfo{Serial: server.Serial(), Version: server.Version(),
+			Name: structure.MiniserverName, grouping: cfg.MQTT.Devices,
+			topicBase: cfg.MQTT.Topic, qualifyIDs: cfg.QualifyIDs},
+		entities: make(map[uuid.UUID]*entity),
+		states:   make(map[uuid.UUID]*entity),
+		hidden:   make(map[uuid.UUID]*entity),
+		actions:  make(chan string, 2),
+		fetches:  make(chan *entity, 1),
+		fetched:  make(chan messageFetch),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if cfg.MQTT.Discovery {
+		b.discoveryPrefix = b.prefix()
+	}
+	queueSize := cfg.MQTT.QueueSize
+	if queueSize <= 0 {
+		queueSize = 1000
+	}
+	b.queue = newPublishQueue(queueSize)
+	b.held = newHeldStates()
+	if cfg.MQTT.JSONState {
+		delay := cfg.MQTT.JSONDebounce
+		if delay == 0 {
+			delay = 250 * time.Millisecond
+		}
+		b.jsonStates = newJSONStatePublisher(delay)
+	}
+
+	for uu, le := range structure.Controls {
+		ent := &entity{Entity: le, miniserver: &b.miniserver, derived: make(map[string]string),
+			published: make(map[string]lastPublish), seen: make(map[string]bool)}
+		if !cfg.Controls.exposed(le) {
+			b.hidden[uu] = ent
+			continue
+		}
+		for _, stateuu := range le.States {
+			b.states[stateuu] = ent
+		}
+		b.entities[uu] = ent
+	}
+	applyOverrides(cfg.Overrides, b.entities)
+	logging.Subsystem("mqtt").Info("Exposing controls", "topic", b.miniserver.topic(), "exposed", len(b.entities),
+		"excluded", len(b.hidden))
+	return b, nil
+}
+
+/* Return the Home Assistant YAML configuration for the exposed controls. */
+func (b *Bridge) HassYaml() (string, error) {
+	return hassYaml(b.entities)
+}
+
+/* Return the discovery configs for the exposed controls, using the
+ * discovery prefix from the configuration even if discovery is disabled.
+ */
+func (b *Bridge) DiscoveryConfigs() []DiscoveryConfig {
+	return discoveryConfigs(b.prefix(), b.entities)
+}
+
+/* Publish the discovery configs for the exposed controls, and remove those
+ * of excluded controls, once connected. This is done automatically on
+ * connecting if discovery is enabled.
+ */
+func (b *Bridge) PublishDiscovery() error {
+	if !b.MQTTConnected() {
+		return fmt.Errorf("Not connected to the MQTT server")
+	}
+	publishDiscovery(b.client, b.prefix(), b.entities)
+	removeDiscovery(b.client, b.prefix(), b.hidden)
+	return nil
+}
+
+func (b *Bridge) prefix() string {
+	if len(b.cfg.MQTT.DiscoveryPrefix) > 0 {
+		return b.cfg.MQTT.DiscoveryPrefix
+	}
+	return "homeassistant"
+}
+
+/* Counters for the MQTT publish queue. */
+func (b *Bridge) PublishStats() PublishStats {
+	return b.queue.snapshot()
+}
+
+/* Pass status updates from the Miniserver to MQTT and commands from MQTT to
+ * the Miniserver until Close is called. The message center entries are
+ * requested before status updates are enabled, as the flood of initial
+ * status updates would otherwise delay the response.
+ */
+func (b *Bridge) Run() error {
+	b.lock.Lock()
+	b.running = true
+	b.lock.Unlock()
+	defer close(b.done)
+
+	go b.commandSender()
+	if mc := b.messageCenter(); mc != nil {
+		go b.messageFetcher()
+		b.requestMessages(mc)
+	}
+	if err := b.server.EnableUpdates(); err != nil {
+		return err
+	}
+	for {
+		select {
+		case msg := <-b.server.Updates():
+			b.handleUpdate(msg)
+		case <-b.jsonStates.ready():
+			b.jsonStates.flush(b.queue)
+		case <-b.held.ready():
+			b.publishHeld()
+		case res := <-b.fetched:
+			b.publishMessages(res)
+		case <-b.stop:
+			return nil
+		}
+	}
+}
+
+/* Stop Run, waiting for it to return, and disconnect from the MQTT
+ * server.
+ */
+func (b *Bridge) Close() {
+	b.closeOnce.Do(func() {
+		close(b.stop)
+		b.lock.Lock()
+		running, client := b.running, b.client
+		b.lock.Unlock()
+		if running {
+			<-b.done
+		}
+		if client != nil {
+			client.Disconnect(250)
+		}
+	})
+}
+
+/* Send the commands received over MQTT until Close is called. This is kept
+ * apart from Run, as waiting for the response must not hold up status
+ * updates.
+ */
+func (b *Bridge) commandSender() {
+	for {
+		select {
+		case cmd := <-b.actions:
+			b.server.SendCommand(cmd)
+		case <-b.stop:
+			return
+		}
+	}
+}
+
+func (b *Bridge) messageCenter() *entity {
+	if b.structure.MessageCenter == nil {
+		return nil
+	}
+	return b.entities[b.structure.MessageCenter.ActionUUID]
+}
+
+func (b *Bridge) handleUpdate(msg loxone.StatusMessage) {
+	var changed []*entity
+	for _, ev := range b.structure.Update(msg) {
+		if b.OnState != nil {
+			b.OnState(ev)
+		}
+		if ev.Entity.Type == "WeatherServer" {
+			b.publishWeather(ev)
+			continue
+		}
+		le, ck := b.states[ev.UUID]
+		if !ck {
+			continue
+		}
+		if b.publishState(le, ev) {
+			changed = append(changed, le)
+		}
+	}
+	b.jsonStates.changed(changed)
+	if mc := b.messageCenter(); mc != nil && containsEntity(changed, mc) {
+		b.requestMessages(mc)
+	}
+}
+
+/* Publish a new state value, along with any derived topics whose value has
+ * changed as a result. Returns false if the publish filters dropped the
+ * value.
+ */
+func (b *Bridge) publishState(le *entity, ev loxone.StateEvent) bool {
+	if le.Type == "GlobalStates" && ev.State == "notifications" {
+		if text, ck := ev.Value.(string); ck {
+			b.publishNotification(text)
+		}
+	}
+	for name, val := range le.derivedStates() {
+		if last, ck := le.derived[name]; ck && last == val {
+			continue
+		}
+		le.derived[name] = val
+		b.queue.push(mqttState{le.topic(name), val})
+	}
+	return b.publishValue(le, ev)
+}
+
+/* Publish a state value unless the publish filters drop it, holding it
+ * back if it is only too soon after the last value.
+ */
+func (b *Bridge) publishValue(le *entity, ev loxone.StateEvent) bool {
+	publish, wait := le.shouldPublish(b.cfg.Filters, ev.State, ev.Value)
+	if wait > 0 {
+		b.held.hold(le, ev, wait)
+	} else {
+		b.held.release(le, ev.State)
+	}
+	if !publish {
+		return false
+	}
+	switch v := ev.Value.(type) {
+	case float64:
+		b.queue.push(mqttState{b.miniserver.stateTopic(ev.UUID), fmt.Sprintf("%f", v)})
+		if format := le.StateFormat(ev.State); len(format) > 0 {
+			b.queue.push(mqttState{b.miniserver.formattedTopic(ev.UUID), loxone.FormatValue(format, v)})
+		}
+	case string:
+		b.queue.push(mqttState{b.miniserver.stateTopic(ev.UUID), v})
+	}
+	return true
+}
+
+/* Publish the values held back by the publish filters that are now due. */
+func (b *Bridge) publishHeld() {
+	var changed []*entity
+	for _, held := range b.held.due(time.Now()) {
+		if b.publishValue(held.le, held.ev) {
+			changed = append(changed, held.le)
+		}
+	}
+	b.jsonStates.changed(changed)
+	if mc := b.messageCenter(); mc != nil && containsEntity(changed, mc) {
+		b.requestMessages(mc)
+	}
+}
+
+func (b *Bridge) publishWeather(ev loxone.StateEvent) {
+	entries, ck := ev.Value.([]loxone.WeatherEntry)
+	if !ck {
+		return
+	}
+	var data interface{} = entries
+	topic := b.miniserver.topic(weatherForecastTopic)
+	if ev.State == "actual" {
+		if len(entries) == 0 {
+			return
+		}
+		data, topic = entries[0], b.miniserver.topic(weatherCurrentTopic)
+	}
+	payload, err := json.Marshal(data)
+	if err != nil {
+		logging.Subsystem("mqtt").Error("Unable to encode weather data", "error", err)
+		return
+	}
+	b.queue.push(mqttState{topic, string(payload)})
+}
+
+func containsEntity(entities []*entity, le *entity) bool {
+	for _, e := range entities {
+		if e == le {
+			return true
+		}
+	}
+	return false
+}
+
+func (le entity) topic(name string) string {
+	if le.Type == "GlobalStates" {
+		return le.miniserver.topic("global", name)
+	}
+	return le.miniserver.topic(le.ActionUUID.String(), name)
+}
+
+/* Some controls need values that combine several states, e.g. the lock-out
+ * flags of a gate, so these are published on additional topics below the
+ * action UUID.
+ */
+func (le entity) derivedStates() map[string]string {
+	rv := make(map[string]string)
+	switch le.Type {
+	case "Gate", "CentralGate":
+		attrs, err := json.Marshal(map[string]bool{
+			"prevent_open":  le.FloatValue("preventOpen") != 0,
+			"prevent_close": le.FloatValue("preventClose") != 0,
+		})
+		if err == nil {
+			rv["attributes"] = string(attrs)
+		}
+	case "Alarm", "SmokeAlarm":
+		rv["alarm_state"] = le.alarmState()
+	case "GlobalStates":
+		return le.globalStates()
+	case "AudioZone", "AudioZoneV2":
+		media, err := json.Marshal(le.audioZoneState())
+		if err == nil {
+			rv["media"] = string(media)
+		}
+	}
+	return rv
+}
+
+/* Translate the Loxone alarm states into a Home Assistant alarm panel
+ * state. A SmokeAlarm has no armed state as it is always active unless it
+ * has been put into service mode.
+ */
+func (le entity) alarmState() string {
+	armed := le.FloatValue("armed") != 0
+	if le.Type == "SmokeAlarm" {
+		armed = le.FloatValue("timeServiceMode") == 0
+	}
+	switch {
+	case le.FloatValue("level") > 0:
+		return "triggered"
+	case le.FloatValue("nextLevel") > 0:
+		return "pending"
+	case le.FloatValue("armedDelay") > 0:
+		return "arming"
+	case armed && le.FloatValue("disabledMove") != 0:
+		return "armed_home"
+	case armed:
+		return "armed_away"
+	}
+	return "disarmed"
+}
+
+/* Global values are published as text on loxone/global/<name>, translating
+ * the operating mode ID into its name and sunrise/sunset, given as minutes
+ * since midnight, into a time.
+ */
+func (le entity) globalStates() map[string]string {
+	rv := make(map[string]string)
+	for name, val := range le.Values {
+		switch v := val.(type) {
+		case string:
+			rv[name] = v
+		case float64:
+			switch name {
+			case "operatingMode":
+				rv[name] = le.OperatingModeName(v)
+			case "sunrise", "sunset":
+				rv[name] = fmt.Sprintf("%02d:%02d", int(v)/60, int(v)%60)
+			default:
+				rv[name] = strconv.FormatFloat(v, 'f', -1, 64)
+			}
+		}
+	}
+	return rv
+}
@@ -0,0 +1,503 @@
+package mqttbridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/google/uuid"
+	broker "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/zathras777/halox/internal/fakeminiserver"
+	"github.com/zathras777/halox/loxone"
+)
+
+const (
+	kitchenLight   = "10000001-0000-0001-ffff000000000001"
+	outsideTemp    = "10000005-0000-0001-ffff000000000002"
+	testUser       = "admin"
+	testPassword   = "secret"
+	updateDeadline = 5 * time.Second
+	notifications  = "1a000001-0000-0001-ffff000000000004"
+	pushbutton     = "10000002-0000-0001-ffff000000000001"
+	garageDoor     = "10000004-0000-0001-ffff000000000001"
+	messageCenter  = "1e000001-0000-0001-ffff000000000001"
+	messageChanged = "1e000001-0000-0001-ffff000000000002"
+)
+
+type mqttMessage struct {
+	topic    string
+	payload  string
+	retained bool
+}
+
+/* Start an in-process MQTT broker, returning the port it listens on. */
+func startBroker(t *testing.T) int {
+	t.Helper()
+	server := broker.New(&broker.Options{
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err := server.AddHook(new(auth.AllowHook), nil); err != nil {
+		t.Fatal(err)
+	}
+	tcp := listeners.NewTCP(listeners.Config{ID: "test", Address: "127.0.0.1:0"})
+	if err := server.AddListener(tcp); err != nil {
+		t.Fatalf("Unable to start MQTT broker: %s", err)
+	}
+	go server.Serve()
+	t.Cleanup(func() { server.Close() })
+
+	_, port, _ := strings.Cut(tcp.Address(), ":")
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatalf("Unexpected broker address %s", tcp.Address())
+	}
+	return n
+}
+
+func testUUID(t *testing.T, uuidStr string) uuid.UUID {
+	t.Helper()
+	uu, err := loxone.ParseUUID(uuidStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return uu
+}
+
+/* Connect a bridge to a fake Miniserver and an embedded broker and run it
+ * until the test ends.
+ */
+func startBridge(t *testing.T) (*fakeminiserver.Server, *Bridge, int) {
+	t.Helper()
+	port := startBroker(t)
+	fake := fakeminiserver.Start(t)
+	b := runBridge(t, fake, Config{MQTT: MQTTConfig{Host: "127.0.0.1", Port: port, QoS: 1, Discovery: true}})
+	return fake, b, port
+}
+
+func runBridge(t *testing.T, fake *fakeminiserver.Server, cfg Config) *Bridge {
+	t.Helper()
+	ls, data := fakeminiserver.ConnectClient(t, fake, loxone.NewServer)
+	b, err := New(ls, loxone.NewStructure(data, ls.Serial()), cfg)
+	if err != nil {
+		t.Fatalf("New() failed: %s", err)
+	}
+	if err := b.Connect(); err != nil {
+		t.Fatalf("Connect() failed: %s", err)
+	}
+	go b.Run()
+	t.Cleanup(b.Close)
+	return b
+}
+
+/* Subscribe a separate client to the topic filter, collecting every
+ * message received.
+ */
+func subscribe(t *testing.T, port int, filter string) <-chan mqttMessage {
+	t.Helper()
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(fmt.Sprintf("tcp://127.0.0.1:%d", port))
+	opts.SetClientID(fmt.Sprintf("test-%d", time.Now().UnixNano()))
+	c := mqtt.NewClient(opts)
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatalf("Unable to connect test client: %s", token.Error())
+	}
+	t.Cleanup(func() { c.Disconnect(100) })
+
+	msgs := make(chan mqttMessage, 1000)
+	token := c.Subscribe(filter, 1, func(c mqtt.Client, msg mqtt.Message) {
+		msgs <- mqttMessage{msg.Topic(), string(msg.Payload()), msg.Retained()}
+	})
+	if token.Wait() && token.Error() != nil {
+		t.Fatalf("Unable to subscribe to %s: %s", filter, token.Error())
+	}
+	return msgs
+}
+
+/* Wait for a message on the topic, optionally with the given payload. */
+func waitForMessage(t *testing.T, msgs <-chan mqttMessage, topic, payload string) mqttMessage {
+	t.Helper()
+	deadline := time.After(updateDeadline)
+	for {
+		select {
+		case msg := <-msgs:
+			if msg.topic == topic && (len(payload) == 0 || msg.payload == payload) {
+				return msg
+			}
+		case <-deadline:
+			t.Fatalf("No message '%s' received on %s", payload, topic)
+		}
+	}
+}
+
+func publish(t *testing.T, port int, topic, payload string) {
+	t.Helper()
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(fmt.Sprintf("tcp://127.0.0.1:%d", port))
+	c := mqtt.NewClient(opts)
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatalf("Unable to connect test client: %s", token.Error())
+	}
+	defer c.Disconnect(100)
+	if token := c.Publish(topic, 1, false, payload); token.Wait() && token.Error() != nil {
+		t.Fatalf("Unable to publish to %s: %s", topic, token.Error())
+	}
+}
+
+func TestMQTTDiscovery(t *testing.T) {
+	_, b, port := startBridge(t)
+	uu := testUUID(t, kitchenLight)
+
+	le := b.entities[uu]
+	topic := fmt.Sprintf("homeassistant/switch/%s/config", uu)
+	waitForMessage(t, subscribe(t, port, "homeassistant/#"), topic, "")
+
+	// Discovery may be published after the first subscription, so check it
+	// was retained with a second.
+	msg := waitForMessage(t, subscribe(t, port, topic), topic, "")
+	if !msg.retained {
+		t.Error("Discovery config is not retained")
+	}
+	var config map[string]interface{}
+	if err := json.Unmarshal([]byte(msg.payload), &config); err != nil {
+		t.Fatalf("Invalid discovery config: %s", err)
+	}
+	expected := map[string]string{
+		"name":          "Kitchen Light",
+		"unique_id":     uu.String(),
+		"state_topic":   b.miniserver.stateTopic(le.States["active"]),
+		"command_topic": b.miniserver.actionTopic(uu),
+	}
+	for key, value := range expected {
+		if config[key] != value {
+			t.Errorf("Discovery %s is '%v', expected '%s'", key, config[key], value)
+		}
+	}
+}
+
+func TestMQTTStateTopics(t *testing.T) {
+	fake, b, port := startBridge(t)
+	uu := testUUID(t, outsideTemp)
+
+	live := subscribe(t, port, "loxone/#")
+	waitForMessage(t, live, b.miniserver.stateTopic(uu), "0.000000")
+	fake.SetValue(outsideTemp, 21.46)
+	waitForMessage(t, live, b.miniserver.stateTopic(uu), "21.460000")
+	waitForMessage(t, live, b.miniserver.formattedTopic(uu), "21.5°C")
+
+	// A new subscriber receives the last state as a retained message.
+	msg := waitForMessage(t, subscribe(t, port, b.miniserver.stateTopic(uu)), b.miniserver.stateTopic(uu), "")
+	if !msg.retained || msg.payload != "21.460000" {
+		t.Errorf("Retained state %+v, expected retained 21.460000", msg)
+	}
+}
+
+func TestMQTTEventsNotRetained(t *testing.T) {
+	fake, b, port := startBridge(t)
+
+	topic := b.miniserver.topic(notificationTopic)
+	live := subscribe(t, port, topic)
+	fake.SetText(notifications, `{"uid": "n1", "ts": 1600000000, "title": "Doorbell", "message": "Someone is at the door", "data": {"lvl": 1}}`)
+	msg := waitForMessage(t, live, topic, "")
+	var ev loxoneEvent
+	if err := json.Unmarshal([]byte(msg.payload), &ev); err != nil {
+		t.Fatalf("Invalid notification: %s", err)
+	}
+	if ev.ID != "n1" || ev.Title != "Doorbell" || ev.Severity != "info" {
+		t.Errorf("Unexpected notification %+v", ev)
+	}
+
+	select {
+	case msg := <-subscribe(t, port, topic):
+		t.Errorf("Notification was retained: %+v", msg)
+	case <-time.After(250 * time.Millisecond):
+	}
+}
+
+func TestMQTTCommands(t *testing.T) {
+	fake, b, port := startBridge(t)
+	tests := []struct {
+		uuidStr string
+		payload string
+		command string
+	}{
+		{kitchenLight, "1.000000", "On"},
+		{kitchenLight, "0.000000", "Off"},
+		{pushbutton, "pulse", "pulse"},
+		{garageDoor, "open", "open"},
+		{kitchenLight, "Pulse", "Pulse"},
+		{kitchenLight, "21.50", "21.5"},
+	}
+	for _, tc := range tests {
+		publish(t, port, b.miniserver.actionTopic(testUUID(t, tc.uuidStr)), tc.payload)
+		received, err := fake.WaitCommand(updateDeadline)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.payload, err)
+		}
+		expected := "jdev/sps/io/" + tc.uuidStr + "/" + tc.command
+		if received != expected {
+			t.Errorf("Received command %s, expected %s", received, expected)
+		}
+	}
+
+	// Commands not allowed for a control are not sent to the Miniserver.
+	publish(t, port, b.miniserver.actionTopic(testUUID(t, pushbutton)), "reboot")
+	publish(t, port, b.miniserver.actionTopic(testUUID(t, pushbutton)), "on")
+	received, err := fake.WaitCommand(updateDeadline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "jdev/sps/io/" + pushbutton + "/on"; received != expected {
+		t.Errorf("Received command %s, expected %s", received, expected)
+	}
+
+	// Controls without a list of commands only accept the generic ones.
+	publish(t, port, b.miniserver.actionTopic(testUUID(t, kitchenLight)), "reboot")
+	publish(t, port, b.miniserver.actionTopic(testUUID(t, kitchenLight)), "NaN")
+	publish(t, port, b.miniserver.actionTopic(testUUID(t, kitchenLight)), "off")
+	received, err = fake.WaitCommand(updateDeadline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "jdev/sps/io/" + kitchenLight + "/off"; received != expected {
+		t.Errorf("Received command %s, expected %s", received, expected)
+	}
+}
+
+func TestMQTTConnected(t *testing.T) {
+	_, b, _ := startBridge(t)
+	if !b.MQTTConnected() {
+		t.Error("MQTTConnected() false after Connect()")
+	}
+	b.Close()
+	if b.MQTTConnected() {
+		t.Error("MQTTConnected() true after Close()")
+	}
+}
+
+func TestMultipleMiniservers(t *testing.T) {
+	port := startBroker(t)
+	uu := testUUID(t, kitchenLight)
+	tempUU := testUUID(t, outsideTemp)
+	live := subscribe(t, port, "#")
+
+	fakes := make(map[string]*fakeminiserver.Server)
+	bridges := make(map[string]*Bridge)
+	for n, name := range []string{"house", "garage"} {
+		fake := fakeminiserver.Start(t)
+		fake.Serial = fmt.Sprintf("504F9400000%d", n+1)
+		fakes[name] = fake
+		bridges[name] = runBridge(t, fake, Config{QualifyIDs: true,
+			MQTT: MQTTConfig{Host: "127.0.0.1", Port: port, QoS: 1, Topic: "loxone/" + name, Discovery: true}})
+	}
+
+	for name, b := range bridges {
+		// The configs are retained, so use a subscription for each one rather
+		// than skipping past those of the other Miniserver.
+		topic := fmt.Sprintf("homeassistant/switch/%s_%s/config", fakes[name].Serial, uu)
+		msg := waitForMessage(t, subscribe(t, port, topic), topic, "")
+		var config map[string]interface{}
+		if err := json.Unmarshal([]byte(msg.payload), &config); err != nil {
+			t.Fatalf("Invalid discovery config: %s", err)
+		}
+		if expected := "loxone/" + name + "/" + uu.String() + "/action"; config["command_topic"] != expected {
+			t.Errorf("Command topic %v, expected %s", config["command_topic"], expected)
+		}
+		if config["unique_id"] != fakes[name].Serial+"_"+uu.String() {
+			t.Errorf("Unique ID %v is not qualified by the serial number", config["unique_id"])
+		}
+		if b.miniserver.stateTopic(tempUU) != "loxone/"+name+"/"+tempUU.String()+"/state" {
+			t.Errorf("State topic %s is not below loxone/%s", b.miniserver.stateTopic(tempUU), name)
+		}
+	}
+
+	// States and commands only go to and from their own Miniserver.
+	fakes["garage"].SetValue(outsideTemp, 12.5)
+	waitForMessage(t, live, bridges["garage"].miniserver.stateTopic(tempUU), "12.500000")
+	publish(t, port, bridges["house"].miniserver.actionTopic(uu), "on")
+	received, err := fakes["house"].WaitCommand(updateDeadline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "jdev/sps/io/" + kitchenLight + "/on"; received != expected {
+		t.Errorf("Received command %s, expected %s", received, expected)
+	}
+	if cmd, err := fakes["garage"].WaitCommand(250 * time.Millisecond); err == nil {
+		t.Errorf("Command %s sent to the wrong Miniserver", cmd)
+	}
+}
+
+func TestMessageCenterFetch(t *testing.T) {
+	var structure map[string]interface{}
+	if err := json.Unmarshal(fakeminiserver.DefaultStructure(), &structure); err != nil {
+		t.Fatal(err)
+	}
+	structure["messageCenter"] = map[string]interface{}{"uuidAction": messageCenter,
+		"states": map[string]interface{}{"changed": messageChanged}}
+	data, err := json.Marshal(structure)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake, err := fakeminiserver.NewWithStructure("127.0.0.1:0", testUser, testPassword, data)
+	if err != nil {
+		t.Fatalf("Unable to start fake Miniserver: %s", err)
+	}
+	t.Cleanup(fake.Close)
+
+	getEntries := "jdev/sps/io/" + messageCenter + "/getEntries/2"
+	entries := func(ids ...string) map[string]interface{} {
+		var rv []map[string]interface{}
+		for _, id := range ids {
+			rv = append(rv, map[string]interface{}{"entryUuid": id, "title": "Entry " + id, "severity": 2})
+		}
+		return map[string]interface{}{"Entries": rv}
+	}
+	fake.SetResponse(getEntries, entries("m1"))
+
+	port := startBroker(t)
+	live := subscribe(t, port, "loxone/#")
+	b := runBridge(t, fake, Config{MQTT: MQTTConfig{Host: "127.0.0.1", Port: port, QoS: 1}})
+	events := b.miniserver.topic(messageTopic)
+	temp := b.miniserver.stateTopic(testUUID(t, outsideTemp))
+	// The first entries are published once status updates are enabled.
+	waitForMessage(t, live, events, "")
+	if cmd, err := fake.WaitCommand(updateDeadline); err != nil || cmd != getEntries {
+		t.Fatalf("Received command %s (%v), expected %s", cmd, err, getEntries)
+	}
+
+	// Status updates keep being published while the Miniserver is slow to
+	// return the entries, even once more than the updates channel can hold
+	// have been received.
+	delay := 2 * time.Second
+	fake.SetResponse(getEntries, entries("m1", "m2"))
+	fake.SetResponseDelay(getEntries, delay)
+	start := time.Now()
+	fake.SetValue(messageChanged, 1)
+	if _, err := fake.WaitCommand(updateDeadline); err != nil {
+		t.Fatal(err)
+	}
+	for n := 1; n <= 50; n++ {
+		fake.SetValue(outsideTemp, float64(n))
+	}
+	waitForMessage(t, live, temp, "50.000000")
+	if elapsed := time.Since(start); elapsed >= delay {
+		t.Errorf("Status updates held up for %s by fetching the message center entries", elapsed)
+	}
+
+	msg := waitForMessage(t, live, events, "")
+	var ev loxoneEvent
+	if err := json.Unmarshal([]byte(msg.payload), &ev); err != nil {
+		t.Fatalf("Invalid message event: %s", err)
+	}
+	if ev.ID != "m2" || ev.Severity != "error" {
+		t.Errorf("Unexpected message event %+v", ev)
+	}
+}
+
+func TestMinIntervalPublishesLastValue(t *testing.T) {
+	port := startBroker(t)
+	fake := fakeminiserver.Start(t)
+	interval := time.Second
+	b := runBridge(t, fake, Config{MQTT: MQTTConfig{Host: "127.0.0.1", Port: port, QoS: 1},
+		Filters: []PublishFilter{{ControlSelector: ControlSelector{Name: "Outside Temperature"}, MinInterval: interval}}})
+	topic := b.miniserver.stateTopic(testUUID(t, outsideTemp))
+	live := subscribe(t, port, topic)
+	waitForMessage(t, live, topic, "0.000000")
+
+	start := time.Now()
+	for _, value := range []float64{1, 2, 3} {
+		fake.SetValue(outsideTemp, value)
+	}
+	deadline := time.After(updateDeadline)
+	for {
+		select {
+		case msg := <-live:
+			if msg.payload != "3.000000" {
+				t.Fatalf("Value %s published within the minimum interval", msg.payload)
+			}
+			if elapsed := time.Since(start); elapsed < interval/2 {
+				t.Errorf("Last value published after %s, before the interval had passed", elapsed)
+			}
+			return
+		case <-deadline:
+			t.Fatal("Last value held back by the minimum interval was never published")
+		}
+	}
+}
+
+func TestOverrideComponentRemovesConfig(t *testing.T) {
+	port := startBroker(t)
+	fake := fakeminiserver.Start(t)
+	uu := testUUID(t, kitchenLight)
+	switchTopic := fmt.Sprintf("homeassistant/switch/%s/config", uu)
+	lightTopic := fmt.Sprintf("homeassistant/light/%s/config", uu)
+	cfg := Config{MQTT: MQTTConfig{Host: "127.0.0.1", Port: port, QoS: 1, Discovery: true}}
+	b := runBridge(t, fake, cfg)
+	waitForMessage(t, subscribe(t, port, switchTopic), switchTopic, "")
+	b.Close()
+
+	// Once the component is overridden the retained config published for
+	// the original component is cleared.
+	live := subscribe(t, port, "homeassistant/+/"+uu.String()+"/config")
+	cfg.Overrides = map[string]ControlOverride{kitchenLight: {Component: "light"}}
+	runBridge(t, fake, cfg)
+	waitForMessage(t, live, lightTopic, "")
+	deadline := time.After(updateDeadline)
+	for {
+		select {
+		case msg := <-live:
+			if msg.topic == switchTopic && len(msg.payload) == 0 {
+				return
+			}
+		case <-deadline:
+			t.Fatalf("Config on %s was not removed", switchTopic)
+		}
+	}
+}
+
+func TestPublisherStops(t *testing.T) {
+	q := newPublishQueue(10)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		mqttPublisher(nil, q, 1, nil, stop)
+		close(done)
+	}()
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(updateDeadline):
+		t.Fatal("Publisher still running once stopped")
+	}
+}
+
+func TestSlowCommand(t *testing.T) {
+	fake, b, port := startBridge(t)
+	temp := b.miniserver.stateTopic(testUUID(t, outsideTemp))
+	live := subscribe(t, port, temp)
+	waitForMessage(t, live, temp, "")
+
+	// Status updates keep being published while the Miniserver is slow to
+	// respond to a command.
+	delay := 2 * time.Second
+	fake.SetResponseDelay("jdev/sps/io/"+kitchenLight+"/on", delay)
+	start := time.Now()
+	publish(t, port, b.miniserver.actionTopic(testUUID(t, kitchenLight)), "on")
+	if _, err := fake.WaitCommand(updateDeadline); err != nil {
+		t.Fatal(err)
+	}
+	for n := 1; n <= 50; n++ {
+		fake.SetValue(outsideTemp, float64(n))
+	}
+	waitForMessage(t, live, temp, "50.000000")
+	if elapsed := time.Since(start); elapsed >= delay {
+		t.Errorf("Status updates held up for %s by sending a command", elapsed)
+	}
+}
@@ -0,0 +1,66 @@
+package mqttbridge
+
+/* Details of the Miniserver, which is the parent device of every control
+ * in Home Assistant, and how controls are grouped into devices below it,
+ * either "room" for a device per Loxone room or "control" for a device per
+ * control.
+ */
+type miniserverInfo struct {
+	Serial     string
+	Version    string
+	Name       string
+	grouping   string
+	topicBase  string
+	qualifyIDs bool
+}
+
+/* Prefix an ID with the serial number, if configured, so that the IDs of
+ * several Miniservers cannot clash in Home Assistant.
+ */
+func (msi *miniserverInfo) qualify(id string) string {
+	if msi != nil && msi.qualifyIDs {
+		return msi.Serial + "_" + id
+	}
+	return id
+}
+
+func (msi miniserverInfo) hassDevice() map[string]interface{} {
+	return map[string]interface{}{
+		"identifiers":  []string{"loxone_" + msi.Serial},
+		"name":         msi.Name,
+		"manufacturer": "Loxone",
+		"model":        "Miniserver",
+		"sw_version":   msi.Version,
+	}
+}
+
+/* The Home Assistant device an entity belongs to. Controls without a room
+ * belong to the Miniserver itself.
+ */
+func (le entity) hassDevice() map[string]interface{} {
+	if le.miniserver == nil || len(le.miniserver.Serial) == 0 {
+		return nil
+	}
+	if len(le.RoomID) == 0 || len(le.Room) == 0 {
+		return le.miniserver.hassDevice()
+	}
+	via := "loxone_" + le.miniserver.Serial
+	if le.miniserver.grouping == "control" {
+		return map[string]interface{}{
+			"identifiers":    []string{"loxone_" + le.miniserver.qualify(le.UUID.String())},
+			"name":           le.Name,
+			"manufacturer":   "Loxone",
+			"model":          le.Type,
+			"suggested_area": le.Room,
+			"via_device":     via,
+		}
+	}
+	return map[string]interface{}{
+		"identifiers":    []string{"loxone_room_" + le.miniserver.qualify(le.RoomID)},
+		"name":           le.Room,
+		"manufacturer":   "Loxone",
+		"model":          "Room",
+		"suggested_area": le.Room,
+		"via_device":     via,
+	}
+}
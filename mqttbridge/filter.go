@@ -0,0 +1,238 @@
+package mqttbridge
+
+import (
+	"fmt"
+	"math"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/zathras777/halox/loxone"
+)
+
+/* Selects controls by UUID (either the control or action UUID), name,
+ * type, room or category. Names may use shell style wildcards. Every field
+ * that is set has to match.
+ */
+type ControlSelector struct {
+	UUID     string
+	Name     string
+	Type     string
+	Room     string
+	Category string
+}
+
+/* Check the UUID and name pattern, as either being invalid would make the
+ * selector silently match nothing.
+ */
+func (cs ControlSelector) Validate() error {
+	if len(cs.UUID) > 0 {
+		if _, err := loxone.ParseUUID(cs.UUID); err != nil {
+			return fmt.Errorf("'%s' is not a UUID", cs.UUID)
+		}
+	}
+	if _, err := path.Match(cs.Name, ""); err != nil {
+		return fmt.Errorf("Invalid name pattern '%s'", cs.Name)
+	}
+	return nil
+}
+
+func (cs ControlSelector) matches(le *loxone.Entity) bool {
+	if len(cs.UUID) > 0 {
+		uu, err := loxone.ParseUUID(cs.UUID)
+		if err != nil || (uu != le.UUID && uu != le.ActionUUID) {
+			return false
+		}
+	}
+	if len(cs.Name) > 0 {
+		if ok, _ := path.Match(cs.Name, le.Name); !ok {
+			return false
+		}
+	}
+	if len(cs.Type) > 0 && !strings.EqualFold(cs.Type, le.Type) {
+		return false
+	}
+	if len(cs.Room) > 0 && !strings.EqualFold(cs.Room, le.Room) {
+		return false
+	}
+	if len(cs.Category) > 0 && !strings.EqualFold(cs.Category, le.Category) {
+		return false
+	}
+	return true
+}
+
+/* Controls to expose. When include is empty every control is included,
+ * otherwise a control must match at least one include selector. Controls
+ * matching any exclude selector are never exposed.
+ */
+type ControlFilter struct {
+	Include []ControlSelector
+	Exclude []ControlSelector
+}
+
+func (cf ControlFilter) exposed(le *loxone.Entity) bool {
+	included := len(cf.Include) == 0
+	for _, cs := range cf.Include {
+		if cs.matches(le) {
+			included = true
+			break
+		}
+	}
+	if !included {
+		return false
+	}
+	for _, cs := range cf.Exclude {
+		if cs.matches(le) {
+			return false
+		}
+	}
+	return true
+}
+
+/* Limits how often a state is published. The first filter that matches a
+ * control (and state, if given) is used.
+ *   deadband          publish only when the value moves by more than this
+ *   deadband_percent  as deadband, but as a percentage of the last value
+ *   min_interval      publish no more often than this, publishing the last
+ *                     value held back once the interval has passed
+ *   only_on_change    publish only when the value differs from the last
+ */
+type PublishFilter struct {
+	ControlSelector `yaml:",inline"`
+	State           string
+	Deadband        float64
+	DeadbandPercent float64       `yaml:"deadband_percent"`
+	MinInterval     time.Duration `yaml:"min_interval"`
+	OnlyOnChange    bool          `yaml:"only_on_change"`
+}
+
+func (pf PublishFilter) Validate() error {
+	if err := pf.ControlSelector.Validate(); err != nil {
+		return err
+	}
+	if pf.Deadband < 0 || pf.DeadbandPercent < 0 || pf.MinInterval < 0 {
+		return fmt.Errorf("deadband, deadband_percent and min_interval may not be negative")
+	}
+	return nil
+}
+
+type lastPublish struct {
+	value interface{}
+	when  time.Time
+}
+
+func (le *entity) findFilter(filters []PublishFilter, state string) *PublishFilter {
+	for n := range filters {
+		pf := &filters[n]
+		if len(pf.State) > 0 && pf.State != state {
+			continue
+		}
+		if pf.matches(le.Entity) {
+			return pf
+		}
+	}
+	return nil
+}
+
+/* Decide whether a new value for a state should be published and, if so,
+ * record it as the last value published. A value held back only by the
+ * minimum interval returns how long until it can be published.
+ */
+func (le *entity) shouldPublish(filters []PublishFilter, state string, value interface{}) (bool, time.Duration) {
+	pf := le.findFilter(filters, state)
+	if pf == nil {
+		return true, 0
+	}
+	now := time.Now()
+	if last, ck := le.published[state]; ck {
+		if !pf.valueChanged(last.value, value) {
+			return false, 0
+		}
+		if wait := pf.MinInterval - now.Sub(last.when); pf.MinInterval > 0 && wait > 0 {
+			return false, wait
+		}
+	}
+	le.published[state] = lastPublish{value, now}
+	return true, 0
+}
+
+func (pf *PublishFilter) valueChanged(last, value interface{}) bool {
+	lastFloat, lok := last.(float64)
+	valFloat, vok := value.(float64)
+	if !lok || !vok {
+		return !(pf.OnlyOnChange || pf.Deadband > 0 || pf.DeadbandPercent > 0) || last != value
+	}
+	diff := math.Abs(valFloat - lastFloat)
+	if pf.Deadband > 0 && diff <= pf.Deadband {
+		return false
+	}
+	if pf.DeadbandPercent > 0 && diff <= math.Abs(lastFloat)*pf.DeadbandPercent/100 {
+		return false
+	}
+	if pf.OnlyOnChange && diff == 0 {
+		return false
+	}
+	return true
+}
+
+/* States held back by a minimum interval, so the last value is published
+ * once the interval has passed rather than lost. Only the latest value of
+ * each state is kept.
+ */
+type heldStates struct {
+	pending map[heldKey]heldState
+	timer   <-chan time.Time
+	next    time.Time
+}
+
+type heldKey struct {
+	le    *entity
+	state string
+}
+
+type heldState struct {
+	le  *entity
+	ev  loxone.StateEvent
+	due time.Time
+}
+
+func newHeldStates() *heldStates {
+	return &heldStates{pending: make(map[heldKey]heldState)}
+}
+
+func (hs *heldStates) hold(le *entity, ev loxone.StateEvent, wait time.Duration) {
+	due := time.Now().Add(wait)
+	hs.pending[heldKey{le, ev.State}] = heldState{le, ev, due}
+	if hs.timer == nil || due.Before(hs.next) {
+		hs.timer, hs.next = time.After(wait), due
+	}
+}
+
+/* Forget a held value, as a later value has been published or dropped. */
+func (hs *heldStates) release(le *entity, state string) {
+	delete(hs.pending, heldKey{le, state})
+}
+
+/* Channel that fires once the first held value is due. When nothing is
+ * held it is nil and so blocks forever in a select.
+ */
+func (hs *heldStates) ready() <-chan time.Time {
+	return hs.timer
+}
+
+/* Remove and return the held values that are due, setting the timer for
+ * the next of those still held.
+ */
+func (hs *heldStates) due(now time.Time) []heldState {
+	var rv []heldState
+	hs.timer = nil
+	for key, held := range hs.pending {
+		if !held.due.After(now) {
+			rv = append(rv, held)
+			delete(hs.pending, key)
+		} else if hs.timer == nil || held.due.Before(hs.next) {
+			hs.timer, hs.next = time.After(held.due.Sub(now)), held.due
+		}
+	}
+	return rv
+}
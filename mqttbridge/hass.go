@@ -0,0 +1,558 @@
+package mqttbridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/google/uuid"
+	"github.com/zathras777/halox/logging"
+	"github.com/zathras777/halox/loxone"
+	"gopkg.in/yaml.v2"
+)
+
+/* A single Home Assistant MQTT entity. Each Loxone control can be exposed as
+ * one or more of these, e.g. a TimedSwitch is both a switch and a sensor.
+ */
+type hassEntity struct {
+	Component string
+	ObjectID  string
+	Config    map[string]interface{}
+
+	// The component before an override changed it, whose retained config
+	// has to be removed.
+	replaced string
+}
+
+/* Topics are below the configured topic, "loxone" by default, so that
+ * several Miniservers can share an MQTT server.
+ */
+func (msi *miniserverInfo) topic(parts ...string) string {
+	base := defaultTopic
+	if msi != nil && len(msi.topicBase) > 0 {
+		base = msi.topicBase
+	}
+	return strings.Join(append([]string{base}, parts...), "/")
+}
+
+func (msi *miniserverInfo) stateTopic(uu uuid.UUID) string {
+	return msi.topic(uu.String(), "state")
+}
+
+func (msi *miniserverInfo) actionTopic(uu uuid.UUID) string {
+	return msi.topic(uu.String(), "action")
+}
+
+func (msi *miniserverInfo) formattedTopic(uu uuid.UUID) string {
+	return msi.topic(uu.String(), "formatted")
+}
+
+func (le entity) newHassEntity(component, suffix, name string) hassEntity {
+	objectID := le.miniserver.qualify(le.UUID.String())
+	if len(suffix) > 0 {
+		objectID += "_" + suffix
+		name = le.Name + " " + name
+	} else {
+		name = le.Name
+	}
+	he := hassEntity{Component: component, ObjectID: objectID, Config: map[string]interface{}{
+		"name":      name,
+		"unique_id": objectID,
+	}}
+	if device := le.hassDevice(); device != nil {
+		he.Config["device"] = device
+	}
+	return he
+}
+
+func (le entity) hassEntities() []hassEntity {
+	if le.override == nil {
+		return le.hassTypeEntities()
+	}
+	if len(le.override.Name) > 0 {
+		renamed := *le.Entity
+		renamed.Name = le.override.Name
+		le.Entity = &renamed
+	}
+	entities := le.hassTypeEntities()
+	for n := range entities {
+		le.override.apply(&entities[n], le.miniserver.qualify(le.UUID.String()))
+	}
+	return entities
+}
+
+func (le entity) hassTypeEntities() []hassEntity {
+	switch le.Type {
+	case "Pushbutton":
+		return le.hassPushbutton()
+	case "TimedSwitch":
+		return le.hassTimedSwitch()
+	case "Gate", "CentralGate":
+		return le.hassGate()
+	case "Alarm", "SmokeAlarm":
+		return le.hassAlarm()
+	case "AudioZone", "AudioZoneV2":
+		return le.hassAudioZone()
+	case "GlobalStates":
+		return le.hassGlobalStates()
+	case "WeatherServer":
+		return le.hassWeather()
+	case "MessageCenter":
+		he := le.newHassEntity("event", "", "")
+		he.Config["state_topic"] = le.miniserver.topic(messageTopic)
+		he.Config["event_types"] = []string{"message"}
+		return []hassEntity{he}
+	case "InfoOnlyAnalog":
+		return le.hassSensors([]string{"value"})
+	case "Meter":
+		return le.hassSensors([]string{"actual", "total", "totalNeg"})
+	case "Fronius":
+		return le.hassSensors([]string{"prodCurr", "prodCurrDay", "prodCurrMonth", "prodCurrYear",
+			"prodTotal", "consCurr", "consCurrDay", "gridCurr", "batteryCurr", "stateOfCharge"})
+	case "EnergyManager2":
+		return le.hassSensors([]string{"Gpwr", "Ppwr", "Spwr", "Ssoc", "MinSoc"})
+	}
+	return le.hassSwitch()
+}
+
+func (le entity) hassSwitch() []hassEntity {
+	he := le.newHassEntity("switch", "", "")
+	he.Config["command_topic"] = le.miniserver.actionTopic(le.ActionUUID)
+	if stateuu, ck := le.States["active"]; ck {
+		he.Config["state_topic"] = le.miniserver.stateTopic(stateuu)
+		he.Config["payload_on"] = "1.000000"
+		he.Config["payload_off"] = "0.000000"
+	}
+	return []hassEntity{he}
+}
+
+func (le entity) hassPushbutton() []hassEntity {
+	he := le.newHassEntity("button", "", "")
+	he.Config["command_topic"] = le.miniserver.actionTopic(le.ActionUUID)
+	he.Config["payload_press"] = "pulse"
+	return []hassEntity{he}
+}
+
+/* The deactivationDelay state is 0 when off, -1 when permanently on and the
+ * number of seconds remaining when the timer is running.
+ */
+func (le entity) hassTimedSwitch() []hassEntity {
+	sw := le.newHassEntity("switch", "", "")
+	sw.Config["command_topic"] = le.miniserver.actionTopic(le.ActionUUID)
+	sw.Config["payload_on"] = "on"
+	sw.Config["payload_off"] = "off"
+
+	pulse := le.newHassEntity("button", "pulse", "Pulse")
+	pulse.Config["command_topic"] = le.miniserver.actionTopic(le.ActionUUID)
+	pulse.Config["payload_press"] = "pulse"
+
+	rv := []hassEntity{sw, pulse}
+	if stateuu, ck := le.States["deactivationDelay"]; ck {
+		sw.Config["state_topic"] = le.miniserver.stateTopic(stateuu)
+		sw.Config["value_template"] = "{{ 'on' if value | float != 0 else 'off' }}"
+
+		remaining := le.newHassEntity("sensor", "remaining", "Remaining")
+		remaining.Config["state_topic"] = le.miniserver.stateTopic(stateuu)
+		remaining.Config["value_template"] = "{{ [value | float, 0] | max | int }}"
+		remaining.Config["unit_of_measurement"] = "s"
+		remaining.Config["device_class"] = "duration"
+		rv = append(rv, remaining)
+	}
+	return rv
+}
+
+/* Gates report their direction of travel in the active state (1 opening,
+ * -1 closing, 0 stopped) and their position as 0 (closed) to 1 (open).
+ */
+func (le entity) hassGate() []hassEntity {
+	he := le.newHassEntity("cover", "", "")
+	he.Config["device_class"] = "garage"
+	he.Config["command_topic"] = le.miniserver.actionTopic(le.ActionUUID)
+	he.Config["payload_open"] = "open"
+	he.Config["payload_close"] = "close"
+	he.Config["payload_stop"] = "stop"
+	he.Config["json_attributes_topic"] = le.topic("attributes")
+	if stateuu, ck := le.States["active"]; ck {
+		he.Config["state_topic"] = le.miniserver.stateTopic(stateuu)
+		he.Config["value_template"] = "{% if value | float > 0 %}opening{% elif value | float < 0 %}closing{% else %}stopped{% endif %}"
+		he.Config["state_opening"] = "opening"
+		he.Config["state_closing"] = "closing"
+		he.Config["state_stopped"] = "stopped"
+	}
+	if stateuu, ck := le.States["position"]; ck {
+		he.Config["position_topic"] = le.miniserver.stateTopic(stateuu)
+		he.Config["position_template"] = "{{ (value | float * 100) | round(0) }}"
+	}
+	return []hassEntity{he}
+}
+
+/* Arming away enables the movement sensors, arming home leaves them
+ * disabled. Both use a delayed arm so the configured exit delay applies.
+ */
+func (le entity) hassAlarm() []hassEntity {
+	panel := le.newHassEntity("alarm_control_panel", "", "")
+	panel.Config["state_topic"] = le.topic("alarm_state")
+	panel.Config["command_topic"] = le.miniserver.actionTopic(le.ActionUUID)
+	panel.Config["code_arm_required"] = false
+	panel.Config["code_disarm_required"] = false
+	if le.Type == "Alarm" {
+		panel.Config["supported_features"] = []string{"arm_away", "arm_home"}
+		panel.Config["payload_arm_away"] = "delayedon/1"
+		panel.Config["payload_arm_home"] = "delayedon/0"
+		panel.Config["payload_disarm"] = "off"
+	} else {
+		panel.Config["supported_features"] = []string{}
+	}
+
+	ack := le.newHassEntity("button", "acknowledge", "Acknowledge")
+	ack.Config["command_topic"] = le.miniserver.actionTopic(le.ActionUUID)
+	ack.Config["payload_press"] = "quit"
+
+	rv := []hassEntity{panel, ack}
+	if le.Type == "SmokeAlarm" {
+		mute := le.newHassEntity("button", "mute", "Mute")
+		mute.Config["command_topic"] = le.miniserver.actionTopic(le.ActionUUID)
+		mute.Config["payload_press"] = "mute"
+		rv = append(rv, mute)
+	}
+	if stateuu, ck := le.States["disabledMove"]; ck {
+		move := le.newHassEntity("switch", "movement", "Movement Detection")
+		move.Config["command_topic"] = le.miniserver.actionTopic(le.ActionUUID)
+		move.Config["payload_on"] = "dismv/0"
+		move.Config["payload_off"] = "dismv/1"
+		move.Config["state_topic"] = le.miniserver.stateTopic(stateuu)
+		move.Config["value_template"] = "{{ 'dismv/1' if value | float != 0 else 'dismv/0' }}"
+		rv = append(rv, move)
+	}
+	for _, name := range []string{"level", "nextLevel"} {
+		stateuu, ck := le.States[name]
+		if !ck {
+			continue
+		}
+		level := le.newHassEntity("sensor", strings.ToLower(name), alarmSensorNames[name])
+		level.Config["state_topic"] = le.miniserver.stateTopic(stateuu)
+		level.Config["value_template"] = "{{ value | int }}"
+		rv = append(rv, level)
+	}
+	return rv
+}
+
+var alarmSensorNames = map[string]string{
+	"level":     "Alarm Level",
+	"nextLevel": "Next Alarm Level",
+}
+
+/* Home Assistant has no MQTT media player, so a zone is exposed as a set of
+ * simpler entities built on the JSON published to loxone/<uuid>/media.
+ */
+func (le entity) hassAudioZone() []hassEntity {
+	mediaTopic := le.topic("media")
+
+	state := le.newHassEntity("sensor", "play_state", "Play State")
+	state.Config["state_topic"] = mediaTopic
+	state.Config["value_template"] = "{{ value_json.play_state }}"
+	state.Config["json_attributes_topic"] = mediaTopic
+	state.Config["icon"] = "mdi:speaker"
+
+	title := le.newHassEntity("sensor", "title", "Title")
+	title.Config["state_topic"] = mediaTopic
+	title.Config["value_template"] = "{{ value_json.title if value_json.title else value_json.station }}"
+
+	volume := le.newHassEntity("number", "volume", "Volume")
+	volume.Config["command_topic"] = le.miniserver.actionTopic(le.ActionUUID)
+	volume.Config["command_template"] = "volume/{{ value | int }}"
+	volume.Config["state_topic"] = mediaTopic
+	volume.Config["value_template"] = "{{ value_json.volume | int }}"
+	volume.Config["min"] = 0
+	volume.Config["max"] = 100
+
+	power := le.newHassEntity("switch", "power", "Power")
+	power.Config["command_topic"] = le.miniserver.actionTopic(le.ActionUUID)
+	power.Config["payload_on"] = "on"
+	power.Config["payload_off"] = "off"
+	power.Config["state_topic"] = mediaTopic
+	power.Config["value_template"] = "{{ 'on' if value_json.power else 'off' }}"
+
+	rv := []hassEntity{state, title, volume, power}
+	for _, cmd := range []string{"play", "pause", "prev", "next"} {
+		btn := le.newHassEntity("button", cmd, audioButtonNames[cmd])
+		btn.Config["command_topic"] = le.miniserver.actionTopic(le.ActionUUID)
+		btn.Config["payload_press"] = cmd
+		rv = append(rv, btn)
+	}
+	return rv
+}
+
+var audioButtonNames = map[string]string{
+	"play":  "Play",
+	"pause": "Pause",
+	"prev":  "Previous",
+	"next":  "Next",
+}
+
+/* Create a sensor for each of the named states the control has. The unit
+ * comes from the structure file and decides the device and state class, so
+ * that power and energy sensors can be used in the energy dashboard.
+ */
+func (le entity) hassSensors(names []string) []hassEntity {
+	var rv []hassEntity
+	for _, name := range names {
+		stateuu, ck := le.States[name]
+		if !ck {
+			continue
+		}
+		var he hassEntity
+		if len(names) == 1 {
+			he = le.newHassEntity("sensor", "", "")
+		} else {
+			he = le.newHassEntity("sensor", strings.ToLower(name), sensorName(name))
+		}
+		if loxone.FormatIsTime(le.StateFormat(name)) {
+			he.Config["state_topic"] = le.miniserver.formattedTopic(stateuu)
+			rv = append(rv, he)
+			continue
+		}
+		he.Config["state_topic"] = le.miniserver.stateTopic(stateuu)
+		he.Config["state_class"] = "measurement"
+		if strings.Contains(le.StateFormat(name), "<v.t>") {
+			he.Config["unit_of_measurement"] = "s"
+			he.Config["device_class"] = "duration"
+			rv = append(rv, he)
+			continue
+		}
+		unit := le.StateUnit(name)
+		if len(unit) > 0 {
+			he.Config["unit_of_measurement"] = unit
+		}
+		if deviceClass, ck := unitDeviceClasses[unit]; ck {
+			he.Config["device_class"] = deviceClass
+			if deviceClass == "energy" {
+				he.Config["state_class"] = "total_increasing"
+			}
+		}
+		if unit == "%" && (name == "stateOfCharge" || name == "Ssoc") {
+			he.Config["device_class"] = "battery"
+		}
+		rv = append(rv, he)
+	}
+	return rv
+}
+
+var unitDeviceClasses = map[string]string{
+	"W":    "power",
+	"kW":   "power",
+	"MW":   "power",
+	"Wh":   "energy",
+	"kWh":  "energy",
+	"MWh":  "energy",
+	"°C":   "temperature",
+	"°F":   "temperature",
+	"V":    "voltage",
+	"A":    "current",
+	"Hz":   "frequency",
+	"lx":   "illuminance",
+	"hPa":  "pressure",
+	"mbar": "pressure",
+	"km/h": "wind_speed",
+	"m/s":  "wind_speed",
+}
+
+var sensorNames = map[string]string{
+	"actual":        "Actual",
+	"total":         "Total",
+	"totalNeg":      "Total Negative",
+	"prodCurr":      "Production",
+	"prodCurrDay":   "Production Today",
+	"prodCurrMonth": "Production This Month",
+	"prodCurrYear":  "Production This Year",
+	"prodTotal":     "Production Total",
+	"consCurr":      "Consumption",
+	"consCurrDay":   "Consumption Today",
+	"gridCurr":      "Grid",
+	"batteryCurr":   "Battery",
+	"stateOfCharge": "Battery Charge",
+	"Gpwr":          "Grid Power",
+	"Ppwr":          "Production Power",
+	"Spwr":          "Storage Power",
+	"Ssoc":          "Storage Charge",
+	"MinSoc":        "Minimum Storage Charge",
+}
+
+func sensorName(name string) string {
+	if friendly, ck := sensorNames[name]; ck {
+		return friendly
+	}
+	return name
+}
+
+func (le entity) hassGlobalStates() []hassEntity {
+	var rv []hassEntity
+	for _, name := range []string{"operatingMode", "sunrise", "sunset"} {
+		if _, ck := le.States[name]; !ck {
+			continue
+		}
+		he := le.newHassEntity("sensor", strings.ToLower(name), globalSensorNames[name])
+		he.Config["state_topic"] = le.topic(name)
+		he.Config["icon"] = globalSensorIcons[name]
+		rv = append(rv, he)
+	}
+	if _, ck := le.States["notifications"]; ck {
+		he := le.newHassEntity("event", "notifications", "Notifications")
+		he.Config["state_topic"] = le.miniserver.topic(notificationTopic)
+		he.Config["event_types"] = []string{"notification"}
+		rv = append(rv, he)
+	}
+	return rv
+}
+
+/* Sensors for the current weather. The forecast is only available as JSON
+ * on loxone/weather/forecast, see the README for a template weather entity
+ * that uses it.
+ */
+func (le entity) hassWeather() []hassEntity {
+	var rv []hassEntity
+	for _, ws := range weatherSensors {
+		he := le.newHassEntity("sensor", ws.field, ws.name)
+		he.Config["state_topic"] = le.miniserver.topic(weatherCurrentTopic)
+		he.Config["value_template"] = fmt.Sprintf("{{ value_json.%s }}", ws.field)
+		if len(ws.unit) > 0 {
+			he.Config["unit_of_measurement"] = ws.unit
+			he.Config["state_class"] = "measurement"
+		}
+		if len(ws.deviceClass) > 0 {
+			he.Config["device_class"] = ws.deviceClass
+		}
+		if ws.field == "condition" {
+			he.Config["json_attributes_topic"] = le.miniserver.topic(weatherCurrentTopic)
+		}
+		rv = append(rv, he)
+	}
+	return rv
+}
+
+var weatherSensors = []struct {
+	field       string
+	name        string
+	unit        string
+	deviceClass string
+}{
+	{"condition", "Condition", "", ""},
+	{"temperature", "Temperature", "°C", "temperature"},
+	{"apparent_temperature", "Apparent Temperature", "°C", "temperature"},
+	{"humidity", "Humidity", "%", "humidity"},
+	{"pressure", "Pressure", "hPa", "pressure"},
+	{"wind_speed", "Wind Speed", "km/h", "wind_speed"},
+	{"wind_bearing", "Wind Bearing", "°", ""},
+	{"precipitation", "Precipitation", "mm", "precipitation"},
+	{"solar_radiation", "Solar Radiation", "W/m²", "irradiance"},
+}
+
+var globalSensorNames = map[string]string{
+	"operatingMode": "Operating Mode",
+	"sunrise":       "Sunrise",
+	"sunset":        "Sunset",
+}
+
+var globalSensorIcons = map[string]string{
+	"operatingMode": "mdi:home-clock",
+	"sunrise":       "mdi:weather-sunset-up",
+	"sunset":        "mdi:weather-sunset-down",
+}
+
+func hassYaml(entities map[uuid.UUID]*entity) (string, error) {
+	components := make(map[string][]map[string]interface{})
+	for _, le := range sortedEntities(entities) {
+		for _, he := range le.hassEntities() {
+			cfg := map[string]interface{}{"platform": "mqtt"}
+			for k, v := range he.Config {
+				cfg[k] = v
+			}
+			// Only understood by discovery.
+			delete(cfg, "object_id")
+			components[he.Component] = append(components[he.Component], cfg)
+		}
+	}
+	out, err := yaml.Marshal(components)
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+/* A Home Assistant discovery config and the topic it is published on. */
+type DiscoveryConfig struct {
+	Topic   string
+	Payload []byte
+}
+
+func discoveryConfigs(prefix string, entities map[uuid.UUID]*entity) []DiscoveryConfig {
+	var rv []DiscoveryConfig
+	for _, le := range sortedEntities(entities) {
+		for _, he := range le.hassEntities() {
+			payload, err := json.Marshal(he.Config)
+			if err != nil {
+				logging.Subsystem("discovery").Error("Unable to encode discovery config", "object_id", he.ObjectID, "error", err)
+				continue
+			}
+			topic := fmt.Sprintf("%s/%s/%s/config", prefix, he.Component, he.ObjectID)
+			rv = append(rv, DiscoveryConfig{topic, payload})
+		}
+	}
+	return rv
+}
+
+func publishDiscovery(c mqtt.Client, prefix string, entities map[uuid.UUID]*entity) {
+	n := 0
+	for _, dc := range discoveryConfigs(prefix, entities) {
+		token := c.Publish(dc.Topic, byte(1), true, dc.Payload)
+		if token.Wait() && token.Error() != nil {
+			logging.Subsystem("discovery").Error("Error publishing discovery config", "topic", dc.Topic, "error", token.Error())
+			continue
+		}
+		n++
+	}
+	logging.Subsystem("discovery").Info("Published Home Assistant discovery configs", "count", n)
+
+	for _, le := range sortedEntities(entities) {
+		for _, he := range le.hassEntities() {
+			if len(he.replaced) > 0 {
+				clearDiscovery(c, fmt.Sprintf("%s/%s/%s/config", prefix, he.replaced, he.ObjectID))
+			}
+		}
+	}
+}
+
+/* Clear any retained discovery configs for controls that are no longer
+ * exposed, so Home Assistant removes the entities.
+ */
+func removeDiscovery(c mqtt.Client, prefix string, entities map[uuid.UUID]*entity) {
+	for _, le := range sortedEntities(entities) {
+		for _, he := range le.hassEntities() {
+			clearDiscovery(c, fmt.Sprintf("%s/%s/%s/config", prefix, he.Component, he.ObjectID))
+		}
+	}
+}
+
+/* An empty retained payload removes the config and so the entity. */
+func clearDiscovery(c mqtt.Client, topic string) {
+	token := c.Publish(topic, byte(1), true, "")
+	if token.Wait() && token.Error() != nil {
+		logging.Subsystem("discovery").Error("Error removing discovery config", "topic", topic, "error", token.Error())
+	}
+}
+
+func sortedEntities(entities map[uuid.UUID]*entity) []*entity {
+	rv := make([]*entity, 0, len(entities))
+	for _, le := range entities {
+		rv = append(rv, le)
+	}
+	sort.Slice(rv, func(i, j int) bool {
+		if rv[i].Name != rv[j].Name {
+			return rv[i].Name < rv[j].Name
+		}
+		return rv[i].UUID.String() < rv[j].UUID.String()
+	})
+	return rv
+}
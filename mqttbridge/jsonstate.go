@@ -0,0 +1,58 @@
+package mqttbridge
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/zathras777/halox/logging"
+)
+
+/* Publishes the full state of a control as a single JSON document keyed by
+ * the state names. Updates arrive one state at a time, so publishing is
+ * delayed until no more than one document per control is sent for a burst
+ * of updates.
+ */
+type jsonStatePublisher struct {
+	delay   time.Duration
+	pending map[*entity]bool
+	timer   <-chan time.Time
+}
+
+func newJSONStatePublisher(delay time.Duration) *jsonStatePublisher {
+	return &jsonStatePublisher{delay: delay, pending: make(map[*entity]bool)}
+}
+
+func (jp *jsonStatePublisher) changed(entities []*entity) {
+	if jp == nil || len(entities) == 0 {
+		return
+	}
+	for _, le := range entities {
+		jp.pending[le] = true
+	}
+	if jp.timer == nil {
+		jp.timer = time.After(jp.delay)
+	}
+}
+
+/* Channel that fires once the debounce delay has passed. When nothing is
+ * pending it is nil and so blocks forever in a select.
+ */
+func (jp *jsonStatePublisher) ready() <-chan time.Time {
+	if jp == nil {
+		return nil
+	}
+	return jp.timer
+}
+
+func (jp *jsonStatePublisher) flush(mq *publishQueue) {
+	for le := range jp.pending {
+		payload, err := json.Marshal(le.Values)
+		if err != nil {
+			logging.Subsystem("mqtt").Error("Unable to encode JSON state", "control", le.Name, "error", err)
+			continue
+		}
+		mq.push(mqttState{le.topic("json"), string(payload)})
+	}
+	jp.pending = make(map[*entity]bool)
+	jp.timer = nil
+}
@@ -0,0 +1,81 @@
+package mqttbridge
+
+import (
+	"fmt"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/google/uuid"
+	"github.com/zathras777/halox/logging"
+)
+
+type mqttState struct {
+	topic string
+	value string
+}
+
+/* Connect to the MQTT server and start publishing. Home Assistant discovery
+ * configs are published, if enabled, every time the connection is made.
+ */
+func (b *Bridge) Connect() error {
+	cfg := b.cfg.MQTT
+	mqOpts := mqtt.NewClientOptions()
+	mqOpts.AddBroker(fmt.Sprintf("tcp://%s:%d", cfg.Host, cfg.Port))
+	mqOpts.OnConnect = b.mqttConnect
+	mqOpts.SetDefaultPublishHandler(b.actionHandler)
+
+	client := mqtt.NewClient(mqOpts)
+	b.lock.Lock()
+	b.client = client
+	b.lock.Unlock()
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		return fmt.Errorf("Unable to connect to the MQTT server on %s:%d: %v", cfg.Host, cfg.Port, token.Error())
+	}
+	go mqttPublisher(client, b.queue, byte(cfg.QoS), b.OnPublish, b.stop)
+	go publishStatsLogger(b.queue, b.stop)
+	return nil
+}
+
+/* Whether there is currently a connection to the MQTT server. */
+func (b *Bridge) MQTTConnected() bool {
+	b.lock.Lock()
+	client := b.client
+	b.lock.Unlock()
+	return client != nil && client.IsConnectionOpen()
+}
+
+func (b *Bridge) mqttConnect(c mqtt.Client) {
+	if token := c.Subscribe(b.miniserver.topic("+", "action"), 1, nil); token.Wait() && token.Error() != nil {
+		logging.Subsystem("mqtt").Error("Unable to subscribe to required topics", "error", token.Error())
+	} else {
+		logging.Subsystem("mqtt").Info("MQTT connected & subscribed OK")
+	}
+	if len(b.discoveryPrefix) > 0 {
+		publishDiscovery(c, b.discoveryPrefix, b.entities)
+		removeDiscovery(c, b.discoveryPrefix, b.hidden)
+	}
+}
+
+func (b *Bridge) actionHandler(client mqtt.Client, msg mqtt.Message) {
+	logging.Subsystem("mqtt").Debug("Received MQTT message", "topic", msg.Topic(), "payload", string(msg.Payload()))
+
+	// The action UUID is the last level before "action".
+	parts := strings.Split(msg.Topic(), "/")
+	reqUUID, err := uuid.Parse(parts[len(parts)-2])
+	if err != nil {
+		logging.Subsystem("mqtt").Warn("Unable to decode action UUID", "topic", msg.Topic())
+		return
+	}
+	le, ck := b.entities[reqUUID]
+	if !ck {
+		logging.Subsystem("mqtt").Warn("Unknown action UUID", "uuid", reqUUID)
+		return
+	}
+	logging.Subsystem("mqtt").Info("Action requested", "control", le.Name, "payload", string(msg.Payload()))
+	cmd, err := le.Command(msg.Payload())
+	if err != nil {
+		logging.Subsystem("mqtt").Warn("Invalid action", "control", le.Name, "error", err)
+		return
+	}
+	b.actions <- cmd
+}
@@ -0,0 +1,177 @@
+package mqttbridge
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/zathras777/halox/logging"
+	"github.com/zathras777/halox/loxone"
+)
+
+/* A notification or message center entry, published as JSON on one of the
+ * event topics. Message center entries include the topic and payload to
+ * publish to confirm them.
+ */
+type loxoneEvent struct {
+	EventType  string    `json:"event_type"`
+	ID         string    `json:"id"`
+	Title      string    `json:"title"`
+	Message    string    `json:"message"`
+	Timestamp  time.Time `json:"timestamp"`
+	Severity   string    `json:"severity"`
+	Room       string    `json:"room,omitempty"`
+	Control    string    `json:"control,omitempty"`
+	AckTopic   string    `json:"ack_topic,omitempty"`
+	AckPayload string    `json:"ack_payload,omitempty"`
+}
+
+var notificationLevels = map[int]string{
+	1: "info",
+	2: "error",
+}
+
+var messageSeverities = map[int]string{
+	1: "info",
+	2: "error",
+	3: "critical",
+}
+
+/* Notifications arrive as a text state of the notifications global state
+ * containing JSON, e.g.
+ *   {"uid": "...", "ts": 1600000000, "type": 10, "title": "Doorbell",
+ *    "message": "Someone is at the door", "data": {"lvl": 1, "uuid": "..."}}
+ */
+func (b *Bridge) publishNotification(text string) {
+	if len(text) == 0 {
+		return
+	}
+	var notif struct {
+		UID     string
+		Ts      int64
+		Title   string
+		Message string
+		Data    struct {
+			Lvl  int
+			UUID string
+		}
+	}
+	if err := json.Unmarshal([]byte(text), &notif); err != nil {
+		logging.Subsystem("mqtt").Warn("Unable to decode notification", "text", text, "error", err)
+		return
+	}
+	ev := loxoneEvent{
+		EventType: "notification",
+		ID:        notif.UID,
+		Title:     notif.Title,
+		Message:   notif.Message,
+		Timestamp: time.Unix(notif.Ts, 0).UTC(),
+		Severity:  notificationLevels[notif.Data.Lvl],
+	}
+	if len(ev.Severity) == 0 {
+		ev.Severity = "info"
+	}
+	if le := b.structure.FindControl(notif.Data.UUID); le != nil {
+		ev.Control = le.Name
+		ev.Room = le.Room
+	}
+	publishEvent(b.miniserver.topic(notificationTopic), ev, b.queue)
+}
+
+func publishEvent(topic string, ev loxoneEvent, mq *publishQueue) {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		logging.Subsystem("mqtt").Error("Unable to encode event", "id", ev.ID, "error", err)
+		return
+	}
+	mq.pushEvent(mqttState{topic, string(payload)})
+}
+
+/* The result of fetching the message center entries. */
+type messageFetch struct {
+	le      *entity
+	entries []loxone.MessageEntry
+	err     error
+}
+
+/* Ask for the message center entries to be fetched. A request made while
+ * one is waiting to be fetched is dropped, as that fetch will include any
+ * changes.
+ */
+func (b *Bridge) requestMessages(le *entity) {
+	select {
+	case b.fetches <- le:
+	default:
+	}
+}
+
+/* Fetch the message center entries as requested until Close is called,
+ * handing them back to Run to publish.
+ */
+func (b *Bridge) messageFetcher() {
+	for {
+		select {
+		case le := <-b.fetches:
+			entries, err := b.server.MessageEntries(le.Entity)
+			select {
+			case b.fetched <- messageFetch{le, entries, err}:
+			case <-b.stop:
+				return
+			}
+		case <-b.stop:
+			return
+		}
+	}
+}
+
+/* Publish an event for each active message center entry not seen before
+ * and the full list of active entries, retained, on loxone/<uuid>/entries.
+ */
+func (b *Bridge) publishMessages(res messageFetch) {
+	if res.err != nil {
+		logging.Subsystem("mqtt").Error("Unable to fetch message center entries", "error", res.err)
+		return
+	}
+
+	le := res.le
+	var active []loxoneEvent
+	for _, entry := range res.entries {
+		if entry.IsHistoric {
+			continue
+		}
+		ev := b.messageEvent(le, entry)
+		active = append(active, ev)
+		if !le.seen[entry.EntryUUID] {
+			le.seen[entry.EntryUUID] = true
+			publishEvent(b.miniserver.topic(messageTopic), ev, b.queue)
+		}
+	}
+	payload, err := json.Marshal(active)
+	if err == nil {
+		b.queue.push(mqttState{le.topic("entries"), string(payload)})
+	}
+}
+
+func (b *Bridge) messageEvent(le *entity, entry loxone.MessageEntry) loxoneEvent {
+	ev := loxoneEvent{
+		EventType:  "message",
+		ID:         entry.EntryUUID,
+		Title:      entry.Title,
+		Message:    entry.Desc,
+		Severity:   messageSeverities[entry.Severity],
+		Control:    entry.AffectedName,
+		AckTopic:   b.miniserver.actionTopic(le.ActionUUID),
+		AckPayload: "confirm/" + entry.EntryUUID,
+	}
+	if len(ev.Severity) == 0 {
+		ev.Severity = "info"
+	}
+	if len(entry.Timestamps) > 0 {
+		ev.Timestamp = time.Unix(entry.Timestamps[len(entry.Timestamps)-1], 0).UTC()
+	}
+	if len(entry.RoomUUID) > 0 {
+		if uu, err := loxone.ParseUUID(entry.RoomUUID); err == nil {
+			ev.Room = b.structure.Rooms[uu]
+		}
+	}
+	return ev
+}
@@ -0,0 +1,77 @@
+package mqttbridge
+
+import (
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/zathras777/halox/logging"
+	"github.com/zathras777/halox/loxone"
+)
+
+/* Per control changes to how a control is presented to Home Assistant,
+ * configured in the overrides section keyed by control UUID. Icon, device
+ * class, component and invert only apply to the main entity of a control.
+ */
+type ControlOverride struct {
+	Name        string
+	ObjectID    string `yaml:"object_id"`
+	Icon        string
+	DeviceClass string `yaml:"device_class"`
+	Component   string
+	Invert      bool
+}
+
+/* Attach the configured overrides to the matching entities, logging any
+ * that do not match a control.
+ */
+func applyOverrides(overrides map[string]ControlOverride, entities map[uuid.UUID]*entity) {
+	for uuidStr, ov := range overrides {
+		uu, err := loxone.ParseUUID(uuidStr)
+		if err != nil {
+			logging.Subsystem("mqtt").Warn("Invalid UUID in overrides", "uuid", uuidStr, "error", err)
+			continue
+		}
+		found := false
+		for _, le := range entities {
+			if le.UUID == uu || le.ActionUUID == uu {
+				ov := ov
+				le.override = &ov
+				found = true
+			}
+		}
+		if !found {
+			logging.Subsystem("mqtt").Warn("No control found for override", "uuid", uuidStr)
+		}
+	}
+}
+
+func (ov ControlOverride) apply(he *hassEntity, baseID string) {
+	suffix := strings.TrimPrefix(he.ObjectID, baseID)
+	if len(ov.ObjectID) > 0 {
+		he.Config["object_id"] = ov.ObjectID + suffix
+	}
+	if len(suffix) > 0 {
+		return
+	}
+	if len(ov.Icon) > 0 {
+		he.Config["icon"] = ov.Icon
+	}
+	if len(ov.DeviceClass) > 0 {
+		he.Config["device_class"] = ov.DeviceClass
+	}
+	if len(ov.Component) > 0 && ov.Component != he.Component {
+		he.replaced = he.Component
+		he.Component = ov.Component
+		if ov.Component == "binary_sensor" || ov.Component == "sensor" {
+			delete(he.Config, "command_topic")
+		}
+	}
+	if ov.Invert {
+		on, onOk := he.Config["payload_on"]
+		off, offOk := he.Config["payload_off"]
+		if onOk && offOk {
+			he.Config["payload_on"] = off
+			he.Config["payload_off"] = on
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package mqttbridge
+
+import (
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/zathras777/halox/logging"
+)
+
+const (
+	publishBatchSize   = 50
+	publishMaxInflight = 100
+	publishStatsPeriod = 5 * time.Minute
+)
+
+/* Values waiting to be published to MQTT. Only the latest value for each
+ * topic is kept, so a burst of updates for the same state results in a
+ * single publish. Events, such as notifications, are kept separately as
+ * every one has to be published, and are not retained. When the queue is
+ * full the oldest value is dropped.
+ */
+type publishQueue struct {
+	lock    sync.Mutex
+	pending map[string]mqttState
+	order   []string
+	events  []mqttState
+	limit   int
+	signal  chan bool
+
+	stats PublishStats
+}
+
+/* Counters for the values passed to the publish queue and the outcome of
+ * publishing them.
+ */
+type PublishStats struct {
+	Queued    uint64
+	Coalesced uint64
+	Dropped   uint64
+	Published uint64
+	Failed    uint64
+}
+
+func newPublishQueue(limit int) *publishQueue {
+	return &publishQueue{
+		pending: make(map[string]mqttState),
+		limit:   limit,
+		signal:  make(chan bool, 1),
+	}
+}
+
+func (q *publishQueue) push(msg mqttState) {
+	q.lock.Lock()
+	if _, ck := q.pending[msg.topic]; ck {
+		q.stats.Coalesced++
+	} else {
+		if len(q.order) >= q.limit {
+			delete(q.pending, q.order[0])
+			q.order = q.order[1:]
+			q.stats.Dropped++
+		}
+		q.order = append(q.order, msg.topic)
+	}
+	q.pending[msg.topic] = msg
+	q.stats.Queued++
+	q.lock.Unlock()
+	q.notify()
+}
+
+func (q *publishQueue) pushEvent(msg mqttState) {
+	q.lock.Lock()
+	if len(q.events) >= q.limit {
+		q.events = q.events[1:]
+		q.stats.Dropped++
+	}
+	q.events = append(q.events, msg)
+	q.stats.Queued++
+	q.lock.Unlock()
+	q.notify()
+}
+
+func (q *publishQueue) notify() {
+	select {
+	case q.signal <- true:
+	default:
+	}
+}
+
+func (q *publishQueue) takeEvents() []mqttState {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	events := q.events
+	q.events = nil
+	return events
+}
+
+func (q *publishQueue) take(max int) []mqttState {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if max > len(q.order) {
+		max = len(q.order)
+	}
+	batch := make([]mqttState, 0, max)
+	for _, topic := range q.order[:max] {
+		batch = append(batch, q.pending[topic])
+		delete(q.pending, topic)
+	}
+	q.order = q.order[max:]
+	return batch
+}
+
+func (q *publishQueue) snapshot() PublishStats {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.stats
+}
+
+/* Publish queued values in batches without waiting for each one to be
+ * acknowledged, until stop is closed. The tokens are checked by a separate
+ * goroutine, which also limits how many publishes can be outstanding at
+ * once.
+ */
+func mqttPublisher(c mqtt.Client, q *publishQueue, qos byte, onPublish func(time.Duration, error), stop <-chan struct{}) {
+	acks := make(chan publishAck, publishMaxInflight)
+	defer close(acks)
+	go publishAcknowledger(q, acks, onPublish)
+
+	for {
+		select {
+		case <-q.signal:
+		case <-stop:
+			return
+		}
+		for _, msg := range q.takeEvents() {
+			acks <- publishAck{msg, time.Now(), c.Publish(msg.topic, qos, false, msg.value)}
+		}
+		for {
+			batch := q.take(publishBatchSize)
+			if len(batch) == 0 {
+				break
+			}
+			for _, msg := range batch {
+				acks <- publishAck{msg, time.Now(), c.Publish(msg.topic, qos, true, msg.value)}
+			}
+		}
+	}
+}
+
+type publishAck struct {
+	msg   mqttState
+	sent  time.Time
+	token mqtt.Token
+}
+
+func publishAcknowledger(q *publishQueue, acks chan publishAck, onPublish func(time.Duration, error)) {
+	for ack := range acks {
+		ack.token.Wait()
+		err := ack.token.Error()
+		if onPublish != nil {
+			onPublish(time.Since(ack.sent), err)
+		}
+		q.lock.Lock()
+		if err != nil {
+			q.stats.Failed++
+		} else {
+			q.stats.Published++
+		}
+		q.lock.Unlock()
+		if err != nil {
+			logging.Subsystem("mqtt").Error("Error publishing", "topic", ack.msg.topic, "value", ack.msg.value, "error", err)
+		}
+	}
+}
+
+/* Log the publish counters periodically, if they have changed, until stop
+ * is closed.
+ */
+func publishStatsLogger(q *publishQueue, stop <-chan struct{}) {
+	ticker := time.NewTicker(publishStatsPeriod)
+	defer ticker.Stop()
+	var last PublishStats
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		stats := q.snapshot()
+		if stats == last {
+			continue
+		}
+		logging.Subsystem("mqtt").Info("MQTT publish stats", "queued", stats.Queued, "coalesced", stats.Coalesced,
+			"dropped", stats.Dropped, "published", stats.Published, "failed", stats.Failed)
+		last = stats
+	}
+}